@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"pql/util"
+	"sync"
+)
+
+const (
+	// The environment variable naming the local audit file
+	AUDIT_FILE_ENV = "PQL_AUDIT_FILE"
+	// The audit file in the home directory, when the environment variable is not set
+	DEFAULT_AUDIT_FILE = ".pql_audit.jsonl"
+)
+
+var (
+	lock sync.Mutex
+)
+
+// FileName returns the name of the local audit file
+func FileName() string {
+	if name := util.Env("", AUDIT_FILE_ENV); name != "" {
+		return name
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return DEFAULT_AUDIT_FILE
+	}
+	return filepath.Join(home, DEFAULT_AUDIT_FILE)
+}
+
+// Append writes a record to the local audit file, as a line of JSON
+func Append(record interface{}) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	f, err := os.OpenFile(FileName(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// User returns the name of the operating system user running the tool
+func User() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return util.Env("", "USER", "USERNAME")
+}
+
+// Host returns the name of the host running the tool
+func Host() string {
+	h, _ := os.Hostname()
+	return h
+}
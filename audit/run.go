@@ -0,0 +1,209 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"pql/creds"
+	"pql/ddb"
+	"pql/util"
+	"pql/version"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// The environment variable naming a DynamoDB table to put each run record in as well, keyed by a
+	// string "runId" partition key
+	AUDIT_TABLE_ENV = "PQL_AUDIT_TABLE"
+	// The optional profile and region of the audit table, which default to the environment's credentials
+	// and AWS_REGION
+	AUDIT_PROFILE_ENV = "PQL_AUDIT_PROFILE"
+	AUDIT_REGION_ENV  = "PQL_AUDIT_REGION"
+
+	RUN_ID_ATTRIBUTE = "runId"
+
+	// The time allowed to put a run record in the audit table
+	AUDIT_TABLE_TIMEOUT = 10 * time.Second
+
+	// The hash status of an input file that was still being hashed when the run was recorded
+	HASH_PENDING = "pending"
+)
+
+// Run is the audit record of an execution of one of the tools
+type Run struct {
+	Type       string      `json:"type"`
+	RunID      string      `json:"runId"`
+	Tool       string      `json:"tool"`
+	Version    string      `json:"version"`
+	User       string      `json:"user"`
+	Host       string      `json:"host"`
+	Args       []string    `json:"args"`
+	Inputs     []Input     `json:"inputs,omitempty"`
+	Started    time.Time   `json:"started"`
+	Finished   time.Time   `json:"finished"`
+	ExitStatus int         `json:"exitStatus"`
+	Error      string      `json:"error,omitempty"` // The error a failed run exited on
+	Targets    []RunTarget `json:"targets"`
+}
+
+// Input is an input file, with the hash of its content as read (before decompression). Stdin and named
+// pipes can only be read once, so they are not hashed.
+type Input struct {
+	Name       string `json:"name"`
+	SHA256     string `json:"sha256,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	HashStatus string `json:"hashStatus,omitempty"` // HASH_PENDING if the file was not hashed in time
+}
+
+// RunTarget is the account and region a run executed against, with its final counters
+type RunTarget struct {
+	Name     string      `json:"name"`
+	Profile  string      `json:"profile,omitempty"`
+	Region   string      `json:"region"`
+	Operator string      `json:"operator,omitempty"` // The access key ID the credentials resolved to
+	Status   string      `json:"status"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Counters interface{} `json:"counters,omitempty"`
+}
+
+// Operator records the access key ID the credentials of a target resolved to. Its Set method is the
+// credential provider callback passed to creds.LoadConfigWithRef.
+type Operator struct {
+	keyId atomic.Value
+}
+
+func (o *Operator) Set(keyId string) {
+	o.keyId.Store(keyId)
+}
+
+// String returns the access key ID, or "" if the credentials have not been resolved
+func (o *Operator) String() string {
+	if o == nil {
+		return ""
+	}
+	if keyId, ok := o.keyId.Load().(string); ok {
+		return keyId
+	}
+	return ""
+}
+
+// NewRun starts the audit record of a run of a tool
+func NewRun(tool string) *Run {
+	return &Run{
+		Type:    "run",
+		RunID:   newRunID(),
+		Tool:    tool,
+		Version: version.VERSION,
+		User:    User(),
+		Host:    Host(),
+		Args:    os.Args[1:],
+		Started: time.Now(),
+	}
+}
+
+// Finish completes the record of a run with its exit status and appends it to the local audit file, and
+// to the audit table if one is configured. Both are attempted, and the first error is returned.
+func (r *Run) Finish(exitStatus int, endpoint string) error {
+	r.Finished = time.Now()
+	r.ExitStatus = exitStatus
+	err := Append(r)
+	if table := util.Env("", AUDIT_TABLE_ENV); table != "" {
+		if terr := r.put(table, endpoint); err == nil && terr != nil {
+			err = fmt.Errorf("Failed to put run in audit table %s: %s", table, terr.Error())
+		}
+	}
+	return err
+}
+
+// put writes the run as an item of the audit table
+func (r *Run) put(table, endpoint string) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&doc); err != nil {
+		return err
+	}
+	item := make(map[string]types.AttributeValue, len(doc))
+	for k, v := range doc {
+		item[k] = ddb.ToAV(v)
+	}
+
+	key, secret, region := util.Env("", "AWS_ACCESS_KEY_ID"), util.Env("", "AWS_SECRET_ACCESS_KEY"), util.Env("us-east-1", "AWS_REGION")
+	if profile := util.Env("", AUDIT_PROFILE_ENV); profile != "" {
+		pcfg, err := creds.GetProfileCreds(profile)
+		if err != nil {
+			return err
+		}
+		key, secret, region = pcfg[1], pcfg[2], pcfg[3]
+	}
+	cfg, err := creds.LoadConfig(util.Env(region, AUDIT_REGION_ENV), key, secret, endpoint)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AUDIT_TABLE_TIMEOUT)
+	defer cancel()
+	_, err = dynamodb.NewFromConfig(cfg).PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      item,
+	})
+	return err
+}
+
+// HashInputs returns the SHA-256 hash of each regular input file. A file that cannot be read is listed
+// without a hash.
+func HashInputs(names []string) []Input {
+	inputs := make([]Input, len(names))
+	for idx, name := range names {
+		inputs[idx] = Input{Name: name}
+		if info, err := os.Stat(name); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		h := sha256.New()
+		if n, err := io.Copy(h, f); err == nil {
+			inputs[idx].SHA256 = hex.EncodeToString(h.Sum(nil))
+			inputs[idx].Bytes = n
+		}
+		f.Close()
+	}
+	return inputs
+}
+
+// PendingInputs returns the inputs without their hashes, for recording a run before HashInputs completes.
+// The regular files are marked as HASH_PENDING.
+func PendingInputs(names []string) []Input {
+	inputs := make([]Input, len(names))
+	for idx, name := range names {
+		inputs[idx] = Input{Name: name}
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			inputs[idx].HashStatus = HASH_PENDING
+		}
+	}
+	return inputs
+}
+
+// newRunID returns a unique run ID, ordered by the time the run started
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
@@ -8,4 +8,7 @@ env GOOS=windows GOARCH=amd64 go build -o bins/pql.exe
 echo "Built pql.exe for Windows"
 
 
-cp bins/pql ~/bin
\ No newline at end of file
+cp bins/pql ~/bin
+# The old tool names still run their commands, e.g. pqlquery runs "pql query"
+ln -sf pql ~/bin/pqlquery
+ln -sf pql ~/bin/ddbtruncate
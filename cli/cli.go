@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pql/config"
+	"pql/version"
+	"strings"
+)
+
+const (
+	// The name of the binary the commands are run with
+	BINARY_NAME = "pql"
+)
+
+var (
+	// The names the separate tools were installed as, which run their command when the binary is linked to them
+	aliases = map[string]string{
+		"pqlquery":    "query",
+		"ddbtruncate": "truncate",
+		"truncate":    "truncate",
+	}
+)
+
+// Command is a subcommand of the pql binary. Each command defines its own flags, along with the -config and
+// -env flags every command shares, and parses them before it is run.
+type Command struct {
+	Name    string
+	Summary string // One line, for the list of commands
+	Args    string // The usage of the arguments after the flags, e.g. "[file1 file2 .... fileN]"
+	Define  func(fs *flag.FlagSet)
+	Run     func(fs *flag.FlagSet)
+}
+
+// Main runs the command named by the first argument, or the first (default) command when the first argument
+// is not a command, so "pql file.pql" still executes file.pql. The help, completion and version commands are
+// built in.
+func Main(commands ...*Command) {
+	args := os.Args[1:]
+	cmd := commands[0]
+	if name, ok := aliases[strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")]; ok {
+		cmd = find(commands, name)
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "help":
+			help(commands, args[1:])
+			os.Exit(0)
+		case "completion":
+			completion(commands, args[1:])
+			os.Exit(0)
+		case "version":
+			fmt.Printf("%s: v%s\n", BINARY_NAME, version.VERSION)
+			os.Exit(0)
+		}
+		if c := find(commands, args[0]); c != nil {
+			cmd = c
+			args = args[1:]
+		}
+	}
+	fs := FlagSet(cmd)
+	fs.Parse(args)
+	if _, err := config.Apply(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+		os.Exit(-9)
+	}
+	cmd.Run(fs)
+}
+
+// FlagSet returns the flags of a command, defined but not yet parsed
+func FlagSet(cmd *Command) *flag.FlagSet {
+	fs := flag.NewFlagSet(BINARY_NAME+" "+cmd.Name, flag.ExitOnError)
+	cmd.Define(fs)
+	config.Flags(fs)
+	fs.Usage = func() {
+		usage(cmd, fs)
+	}
+	return fs
+}
+
+func find(commands []*Command, name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// usage prints the help of a command: its summary, arguments and flags
+func usage(cmd *Command, fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "%s: v%s\n", BINARY_NAME, version.VERSION)
+	fmt.Fprintf(w, "%s\n", cmd.Summary)
+	fmt.Fprintf(w, "Usage: %s\n", strings.TrimSpace(BINARY_NAME+" "+cmd.Name+" [options] "+cmd.Args))
+	fmt.Fprintf(w, "Options:\n")
+	fs.PrintDefaults()
+}
+
+// help prints the list of commands, or the help of the named command
+func help(commands []*Command, args []string) {
+	if len(args) > 0 {
+		if c := find(commands, args[0]); c != nil {
+			fs := FlagSet(c)
+			fs.SetOutput(os.Stdout)
+			fs.Usage()
+			return
+		}
+		fmt.Fprintf(os.Stderr, "ERROR: Unknown command: %s\n", args[0])
+		os.Exit(-9)
+	}
+	fmt.Printf("%s: v%s\n", BINARY_NAME, version.VERSION)
+	fmt.Printf("Usage: %s <command> [options] [arguments]\n", BINARY_NAME)
+	fmt.Printf("Commands:\n")
+	for idx, c := range commands {
+		summary := c.Summary
+		if idx == 0 {
+			summary += " (the default command)"
+		}
+		fmt.Printf("  %-12s%s\n", c.Name, summary)
+	}
+	fmt.Printf("  %-12s%s\n", "completion", "Print the shell completion script (bash or zsh)")
+	fmt.Printf("  %-12s%s\n", "help", "Print the options of a command")
+	fmt.Printf("  %-12s%s\n", "version", "Print the version")
+	fmt.Printf("Run \"%s help <command>\" for the options of a command.\n", BINARY_NAME)
+}
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	SHELL_BASH = "bash"
+	SHELL_ZSH  = "zsh"
+)
+
+// completion prints the completion script of a shell, which completes the command names, then the flags of
+// the command being typed, and file names otherwise. The flags are taken from the commands themselves, so
+// the script is regenerated rather than edited when they change.
+func completion(commands []*Command, args []string) {
+	shell := SHELL_BASH
+	if len(args) > 0 {
+		shell = args[0]
+	}
+	if shell != SHELL_BASH && shell != SHELL_ZSH {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid shell: %s (bash or zsh)\n", shell)
+		os.Exit(-9)
+	}
+	names := make([]string, 0, len(commands)+3)
+	for _, c := range commands {
+		names = append(names, c.Name)
+	}
+	names = append(names, "completion", "help", "version")
+
+	var b strings.Builder
+	if shell == SHELL_ZSH {
+		b.WriteString("autoload -U +X bashcompinit && bashcompinit\n")
+	}
+	fmt.Fprintf(&b, "# %s completion for %s, install with: source <(%s completion %s)\n", BINARY_NAME, shell, BINARY_NAME, shell)
+	fmt.Fprintf(&b, "_%s() {\n", BINARY_NAME)
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" cmd=\"${COMP_WORDS[1]}\" opts\n")
+	b.WriteString("    if [ \"$COMP_CWORD\" -eq 1 ] && [[ \"$cur\" != -* ]]; then\n")
+	fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(names, " "))
+	b.WriteString("        return\n")
+	b.WriteString("    fi\n")
+	b.WriteString("    case \"$cmd\" in\n")
+	b.WriteString("    completion) COMPREPLY=($(compgen -W \"" + SHELL_BASH + " " + SHELL_ZSH + "\" -- \"$cur\")); return ;;\n")
+	fmt.Fprintf(&b, "    help) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", strings.Join(names[:len(commands)], " "))
+	for _, c := range commands[1:] {
+		fmt.Fprintf(&b, "    %s) opts=\"%s\" ;;\n", c.Name, strings.Join(flagNames(c), " "))
+	}
+	// The default command runs when the first argument is not a command
+	fmt.Fprintf(&b, "    *) opts=\"%s\" ;;\n", strings.Join(flagNames(commands[0]), " "))
+	b.WriteString("    esac\n")
+	b.WriteString("    if [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("        COMPREPLY=($(compgen -W \"$opts\" -- \"$cur\"))\n")
+	b.WriteString("    else\n")
+	b.WriteString("        COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -o filenames -F _%s %s\n", BINARY_NAME, BINARY_NAME)
+	fmt.Print(b.String())
+}
+
+// flagNames returns the flags of a command, as they are typed
+func flagNames(c *Command) []string {
+	names := make([]string, 0, 32)
+	FlagSet(c).VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
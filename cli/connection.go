@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"pql/audit"
+	"pql/creds"
+	"pql/metrics"
+	"pql/util"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+const (
+	AWS_KEY_ENV    = "AWS_ACCESS_KEY_ID"
+	AWS_SECRET_ENV = "AWS_SECRET_ACCESS_KEY"
+	AWS_REGION_ENV = "AWS_REGION"
+
+	DEFAULT_REGION = "us-east-1"
+)
+
+// Connection is the credential, region and endpoint flags of the commands run against one account and region
+type Connection struct {
+	Profile  string
+	Region   string
+	Endpoint string
+	KeyId    string
+	Secret   string
+	Operator audit.Operator // The access key ID the credentials resolved to, once connected
+	resolved bool
+}
+
+// Flags defines the -profile, -region and -endpoint flags
+func (c *Connection) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Profile, "profile", "", "The optional AWS shared config credential profile name")
+	fs.StringVar(&c.Region, "region", "", "The optional AWS region overriding the profile's region")
+	fs.StringVar(&c.Endpoint, "endpoint", util.Env("", creds.ENDPOINT_ENV), "The optional DynamoDB endpoint URL to use instead of AWS, e.g. DynamoDB Local (defaults to $PQL_ENDPOINT)")
+}
+
+// Resolve loads the credentials of the profile, or of the environment without one, exiting if they cannot
+// be loaded
+func (c *Connection) Resolve() {
+	if c.resolved {
+		return
+	}
+	c.resolved = true
+	if c.Profile != "" {
+		key, secret, region, err := ProfileCreds(c.Profile)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err.Error())
+			os.Exit(-10)
+		}
+		c.KeyId, c.Secret = key, secret
+		if c.Region == "" {
+			c.Region = region
+		}
+	} else {
+		c.KeyId = util.Env("", AWS_KEY_ENV)
+		c.Secret = util.Env("", AWS_SECRET_ENV)
+		if c.Region == "" {
+			c.Region = util.Env(DEFAULT_REGION, AWS_REGION_ENV)
+		}
+	}
+}
+
+// Name returns the profile, or the region without a profile, to name the target in logs and audit records
+func (c *Connection) Name() string {
+	if c.Profile != "" {
+		return c.Profile
+	}
+	return c.Region
+}
+
+// Client resolves the credentials, if they have not been, and creates the DynamoDB client
+func (c *Connection) Client() *dynamodb.Client {
+	c.Resolve()
+	cfg, err := creds.LoadConfigWithRef(c.Region, c.KeyId, c.Secret, c.Endpoint, c.Operator.Set)
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	return dynamodb.NewFromConfig(cfg)
+}
+
+// ProfileCreds returns the access key ID, secret and region of a shared config profile
+func ProfileCreds(profile string) (string, string, string, error) {
+	pcfg, err := creds.GetProfileCreds(profile)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Failed to load credentials for profile [%s]: %s", profile, err.Error())
+	}
+	return pcfg[1], pcfg[2], pcfg[3], nil
+}
+
+// ServeMetrics registers a command's metrics and serves them on the address, if one is specified, exiting if
+// the listener cannot be started
+func ServeMetrics(address string, register func()) {
+	if address == "" {
+		return
+	}
+	register()
+	if err := metrics.Serve(address); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to start metrics listener: address=%s, error=%s\n", address, err.Error())
+		os.Exit(-9)
+	}
+}
+
+// ReportEvery calls report on a period until the process exits, for the periodic stats lines
+func ReportEvery(period time.Duration, report func(final bool)) {
+	go func() {
+		for {
+			time.Sleep(period)
+			report(false)
+		}
+	}()
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pql/util"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The environment variables naming the config file and the environment, when -config and -env are not specified
+	CONFIG_ENV      = "PQL_CONFIG"
+	ENVIRONMENT_ENV = "PQL_ENV"
+	// The config file in the home directory, read if it exists
+	DEFAULT_CONFIG_FILE = ".pql.yaml"
+)
+
+var (
+	configName      string
+	environmentName string
+	current         *Environment
+)
+
+// File is a config file of named environments, e.g.
+//
+//	default: dev
+//	environments:
+//	  dev:
+//	    endpoint: http://localhost:8000
+//	    tables:
+//	      bo.accounts: dev.accounts
+//	  prod:
+//	    profile: PROD
+//	    region: us-east-1
+//	    wcu: 500
+//	    protected: true
+type File struct {
+	Default      string                  `yaml:"default"` // The environment used when -env is not specified
+	Environments map[string]*Environment `yaml:"environments"`
+}
+
+// Environment is the settings shared by every tool run against an environment. The settings fill in the
+// flags that were not specified on the command line, so a flag always overrides its environment.
+type Environment struct {
+	Name            string            `yaml:"-"`
+	Profile         string            `yaml:"profile"`
+	Region          string            `yaml:"region"`
+	Endpoint        string            `yaml:"endpoint"`
+	MaxRetries      *int              `yaml:"maxRetries"`
+	Pool            int               `yaml:"pool"`    // The pql executor pool size
+	Readers         int               `yaml:"readers"` // The truncate scan readers
+	WCU             float64           `yaml:"wcu"`
+	RPS             float64           `yaml:"rps"`
+	Protected       bool              `yaml:"protected"`       // Guards destructive operations on every table
+	ProtectedTables []string          `yaml:"protectedTables"` // Patterns of the tables guarded otherwise
+	Tables          map[string]string `yaml:"tables"`          // The names of the faker's tables in the environment
+}
+
+// Flags defines the -config and -env flags of a command
+func Flags(fs *flag.FlagSet) {
+	fs.StringVar(&configName, "config", util.Env("", CONFIG_ENV), "The optional config file of named environments (defaults to $PQL_CONFIG, or ~/"+DEFAULT_CONFIG_FILE+" if it exists)")
+	fs.StringVar(&environmentName, "env", util.Env("", ENVIRONMENT_ENV), "The optional environment in the config file to take default settings from (defaults to $PQL_ENV, or the file's default)")
+}
+
+// Apply loads the environment selected by the -config and -env flags, once they are parsed, and sets the
+// flags of the command that were not specified from its settings. Without a config file, or an environment
+// to select, there is nothing to apply.
+func Apply(fs *flag.FlagSet) (*Environment, error) {
+	name := configName
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		name = filepath.Join(home, DEFAULT_CONFIG_FILE)
+		if _, err := os.Stat(name); err != nil {
+			if environmentName != "" {
+				return nil, fmt.Errorf("No config file for environment %s: %s", environmentName, name)
+			}
+			return nil, nil
+		}
+	}
+	f, err := Load(name)
+	if err != nil {
+		return nil, err
+	}
+	envName := environmentName
+	if envName == "" {
+		envName = f.Default
+	}
+	if envName == "" {
+		return nil, nil
+	}
+	e, ok := f.Environments[envName]
+	if !ok {
+		return nil, fmt.Errorf("No environment %s in config file %s (environments: %s)", envName, name, strings.Join(f.names(), ", "))
+	}
+	e.Name = envName
+	e.setFlags(fs)
+	current = e
+	log.Printf("Environment: name=%s, config=%s\n", envName, name)
+	return e, nil
+}
+
+// Load reads a config file
+func Load(fileName string) (*File, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{}
+	if err = yaml.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", fileName, err.Error())
+	}
+	for name, e := range f.Environments {
+		if e == nil {
+			return nil, errors.New("Empty environment in config file " + fileName + ": " + name)
+		}
+	}
+	return f, nil
+}
+
+func (f *File) names() []string {
+	names := make([]string, 0, len(f.Environments))
+	for name := range f.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setFlags sets each flag a tool defines from the environment's setting, unless it was specified
+func (e *Environment) setFlags(fs *flag.FlagSet) {
+	specified := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		specified[f.Name] = true
+	})
+	settings := map[string]string{
+		"profile":  e.Profile,
+		"region":   e.Region,
+		"endpoint": e.Endpoint,
+	}
+	if e.MaxRetries != nil {
+		settings["maxretries"] = strconv.Itoa(*e.MaxRetries)
+	}
+	if e.Pool > 0 {
+		settings["pool"] = strconv.Itoa(e.Pool)
+	}
+	if e.Readers > 0 {
+		settings["readers"] = strconv.Itoa(e.Readers)
+	}
+	if e.WCU > 0 {
+		settings["wcu"] = strconv.FormatFloat(e.WCU, 'f', -1, 64)
+	}
+	if e.RPS > 0 {
+		settings["rps"] = strconv.FormatFloat(e.RPS, 'f', -1, 64)
+	}
+	for name, value := range settings {
+		if value == "" || specified[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			log.Printf("WARNING: Invalid environment setting: env=%s, setting=%s, value=%s, error=%s\n", e.Name, name, value, err.Error())
+		}
+	}
+}
+
+// Current returns the environment applied, or nil if there is none
+func Current() *Environment {
+	return current
+}
+
+// TableName returns the name a table has in the applied environment, which is the name itself unless it
+// is mapped to another
+func TableName(name string) string {
+	if current != nil {
+		if mapped, ok := current.Tables[name]; ok && mapped != "" {
+			return mapped
+		}
+	}
+	return name
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// applyConfig writes the config file and applies it to a tool's flags parsed from args, with the home
+// directory and environment variables cleared so only the file and args count
+func applyConfig(t *testing.T, config string, args ...string) (*flag.FlagSet, *Environment, error) {
+	t.Helper()
+	current = nil
+	t.Cleanup(func() {
+		current = nil
+	})
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(CONFIG_ENV, "")
+	t.Setenv(ENVIRONMENT_ENV, "")
+	fileName := filepath.Join(t.TempDir(), "pql.yaml")
+	if err := os.WriteFile(fileName, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	Flags(fs)
+	fs.String("profile", "", "")
+	fs.Int("maxretries", 3, "")
+	fs.Int("pool", 10, "")
+	fs.Float64("wcu", 0, "")
+	if err := fs.Parse(append([]string{"-config", fileName}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	e, err := Apply(fs)
+	return fs, e, err
+}
+
+func TestApplyZeroMaxRetries(t *testing.T) {
+	// Unlike the other numbers, zero retries is a setting of its own rather than "not set"
+	fs, _, err := applyConfig(t, "default: prod\nenvironments:\n  prod:\n    maxRetries: 0\n    pool: 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("maxretries").Value.String(); got != "0" {
+		t.Errorf("-maxretries = %s, want 0", got)
+	}
+	if got := fs.Lookup("pool").Value.String(); got != "10" {
+		t.Errorf("-pool = %s, want the flag default for a zero pool", got)
+	}
+}
+
+func TestApplySpecifiedDefaultValueWins(t *testing.T) {
+	// A flag given on the command line overrides its environment even when it repeats the flag default
+	fs, _, err := applyConfig(t, "default: prod\nenvironments:\n  prod:\n    pool: 50\n    wcu: 12.5\n", "-pool", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("pool").Value.String(); got != "10" {
+		t.Errorf("-pool = %s, want 10", got)
+	}
+	if got := fs.Lookup("wcu").Value.String(); got != "12.5" {
+		t.Errorf("-wcu = %s, want 12.5", got)
+	}
+}
+
+func TestApplySkipsFlagsTheToolLacks(t *testing.T) {
+	// truncate has no -pool and pql no -readers, one environment serves both
+	fs, e, err := applyConfig(t, "default: prod\nenvironments:\n  prod:\n    readers: 8\n    rps: 100\n    region: eu-west-1\n    profile: PROD\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Readers != 8 || fs.Lookup("profile").Value.String() != "PROD" {
+		t.Errorf("Readers = %d, -profile = %s", e.Readers, fs.Lookup("profile").Value.String())
+	}
+}
+
+func TestApplyWithoutAnEnvironment(t *testing.T) {
+	fs, e, err := applyConfig(t, "environments:\n  prod:\n    profile: PROD\n")
+	if err != nil || e != nil || Current() != nil {
+		t.Fatalf("Apply() = %v, %v, want no environment without a default or -env", e, err)
+	}
+	if got := fs.Lookup("profile").Value.String(); got != "" {
+		t.Errorf("-profile = %q, want it untouched", got)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		wantErr string
+	}{
+		{"default names no environment", "default: staging\nenvironments:\n  dev: {}\n  prod: {}\n", nil, "environments: dev, prod"},
+		{"empty environment", "default: prod\nenvironments:\n  prod:\n", nil, "Empty environment"},
+		{"invalid YAML", "default: [prod\n", nil, "Invalid config file"},
+		{"wrong type", "default: prod\nenvironments:\n  prod:\n    pool: many\n", nil, "Invalid config file"},
+		{"environment of another file", "default: dev\nenvironments:\n  dev: {}\n", []string{"-env", "prod"}, "No environment prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, e, err := applyConfig(t, tt.config, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Apply() = %v, %v, want an error containing %q", e, err, tt.wantErr)
+			}
+			if Current() != nil {
+				t.Error("Current() set after an error")
+			}
+		})
+	}
+}
+
+func TestApplyMissingHomeFileForAnEnvironment(t *testing.T) {
+	current = nil
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(CONFIG_ENV, "")
+	t.Setenv(ENVIRONMENT_ENV, "prod")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	Flags(fs)
+	fs.Parse(nil)
+	// Asking for an environment without a file to find it in must not silently run against the default account
+	if _, err := Apply(fs); err == nil || !strings.Contains(err.Error(), DEFAULT_CONFIG_FILE) {
+		t.Errorf("Apply() error = %v, want the missing %s", err, DEFAULT_CONFIG_FILE)
+	}
+}
+
+func TestTableNameEmptyMapping(t *testing.T) {
+	defer func() {
+		current = nil
+	}()
+	if got := TableName("bo.users"); got != "bo.users" {
+		t.Errorf("TableName() without an environment = %s", got)
+	}
+	current = &Environment{Tables: map[string]string{"bo.accounts": "dev.accounts", "bo.users": ""}}
+	if got := TableName("bo.users"); got != "bo.users" {
+		t.Errorf("TableName() mapped to nothing = %s, want bo.users", got)
+	}
+	if got := TableName("bo.accounts"); got != "dev.accounts" {
+		t.Errorf("TableName() = %s, want dev.accounts", got)
+	}
+}
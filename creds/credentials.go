@@ -121,6 +121,9 @@ func sharedConfigProfile(profile string) aws.CredentialsProvider {
 const (
 	LOCAL_KEY    = "AWS_ID"
 	LOCAL_SECRET = "AWS_SECRET"
+
+	// The environment variable naming a DynamoDB endpoint to use instead of AWS (e.g. http://localhost:8000)
+	ENDPOINT_ENV = "PQL_ENDPOINT"
 )
 
 func BuildLocalDBChainedCredentialProvider() *ChainedCredentialProvider {
@@ -180,3 +183,38 @@ func GetProfileCreds(profile string) ([]string, error) {
 	}
 	return rez, nil
 }
+
+// LoadConfig builds the SDK config shared by the pql tools. Credentials come from the passed static keys,
+// falling back to the EC2 role. When an endpoint is specified, requests are sent there instead of AWS
+// (e.g. DynamoDB Local) and signed with local credentials.
+func LoadConfig(region, awsKeyId, awsSecret, endpoint string) (aws.Config, error) {
+	return LoadConfigWithRef(region, awsKeyId, awsSecret, endpoint, nil)
+}
+
+// LoadConfigWithRef builds the SDK config like LoadConfig, passing the access key ID of the credentials to
+// the keyIdRef callback each time they are resolved
+func LoadConfigWithRef(region, awsKeyId, awsSecret, endpoint string, keyIdRef func(string)) (aws.Config, error) {
+	if endpoint == "" {
+		return config.LoadDefaultConfig(context.TODO(),
+			config.WithRegion(region),
+			config.WithCredentialsProvider(NewChainedCredentialProviderWithRef(keyIdRef,
+				credentials.NewStaticCredentialsProvider(awsKeyId, awsSecret, ""),
+				ec2rolecreds.New(),
+			)),
+		)
+	}
+	ccp := BuildChainedCredentialProvider(awsKeyId, awsSecret, "", endpoint)
+	ccp.callback = keyIdRef
+	return config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(region),
+		config.WithCredentialsProvider(ccp),
+		config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
+			func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{
+					URL:               endpoint,
+					SigningRegion:     region,
+					HostnameImmutable: true,
+				}, nil
+			})),
+	)
+}
@@ -1,8 +1,12 @@
 package ddb
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -226,3 +230,151 @@ func AVMapToString(item map[string]types.AttributeValue) string {
 		return string(b)
 	}
 }
+
+// ToAV converts a decoded JSON value to an AttributeValue. Numbers should be decoded as json.Number
+// (json.Decoder.UseNumber) to keep their precision.
+func ToAV(v interface{}) types.AttributeValue {
+	switch t := v.(type) {
+	case nil:
+		return &types.AttributeValueMemberNULL{Value: true}
+	case string:
+		return &types.AttributeValueMemberS{Value: t}
+	case json.Number:
+		return &types.AttributeValueMemberN{Value: t.String()}
+	case float64:
+		return &types.AttributeValueMemberN{Value: strconv.FormatFloat(t, 'f', -1, 64)}
+	case int64:
+		return &types.AttributeValueMemberN{Value: strconv.FormatInt(t, 10)}
+	case int:
+		return &types.AttributeValueMemberN{Value: strconv.Itoa(t)}
+	case bool:
+		return &types.AttributeValueMemberBOOL{Value: t}
+	case []interface{}:
+		arr := make([]types.AttributeValue, len(t))
+		for idx, e := range t {
+			arr[idx] = ToAV(e)
+		}
+		return &types.AttributeValueMemberL{Value: arr}
+	case map[string]interface{}:
+		m := make(map[string]types.AttributeValue, len(t))
+		for k, e := range t {
+			m[k] = ToAV(e)
+		}
+		return &types.AttributeValueMemberM{Value: m}
+	}
+	return &types.AttributeValueMemberS{Value: fmt.Sprintf("%v", v)}
+}
+
+// StringToAV converts a string value to an AttributeValue of the named type (S, N, B, BOOL, NULL or JSON, where
+// B decodes the value from base64 and JSON parses the value as a JSON document). When no type is named, the type is inferred: numbers without
+// leading zeros become N, true and false become BOOL and anything else is an S.
+func StringToAV(s, typeName string) (types.AttributeValue, error) {
+	switch strings.ToUpper(typeName) {
+	case "S":
+		return &types.AttributeValueMemberS{Value: s}, nil
+	case "N":
+		if _, err := ToNumberOrErr(s); err != nil || strings.TrimSpace(s) == "" {
+			return nil, errors.New("Invalid number: [" + s + "]")
+		}
+		return &types.AttributeValueMemberN{Value: strings.TrimSpace(s)}, nil
+	case "B":
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s)); err != nil {
+			return nil, errors.New("Invalid base64 binary: [" + s + "]")
+		} else {
+			return &types.AttributeValueMemberB{Value: b}, nil
+		}
+	case "BOOL":
+		if b, err := strconv.ParseBool(strings.TrimSpace(s)); err != nil {
+			return nil, errors.New("Invalid boolean: [" + s + "]")
+		} else {
+			return &types.AttributeValueMemberBOOL{Value: b}, nil
+		}
+	case "NULL":
+		return &types.AttributeValueMemberNULL{Value: true}, nil
+	case "JSON":
+		d := json.NewDecoder(strings.NewReader(s))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return nil, errors.New("Invalid JSON: [" + s + "]: " + err.Error())
+		}
+		return ToAV(v), nil
+	case "":
+		if isNumeric(s) {
+			return &types.AttributeValueMemberN{Value: s}, nil
+		}
+		if s == "true" || s == "false" {
+			return &types.AttributeValueMemberBOOL{Value: s == "true"}, nil
+		}
+		return &types.AttributeValueMemberS{Value: s}, nil
+	}
+	return nil, errors.New("Unsupported type: [" + typeName + "]")
+}
+
+// isNumeric returns true for values that are unambiguously numbers. Values with leading zeros
+// (zip codes, account numbers) are left as strings.
+func isNumeric(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s {
+		return false
+	}
+	digits := strings.TrimPrefix(s, "-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil && !strings.ContainsAny(s, "eEinfINFaA+")
+}
+
+// AVToPartiQL renders an AttributeValue as a PartiQL literal
+func AVToPartiQL(av types.AttributeValue) string {
+	switch t := av.(type) {
+	case *types.AttributeValueMemberS:
+		return QuoteString(t.Value)
+	case *types.AttributeValueMemberN:
+		return t.Value
+	case *types.AttributeValueMemberB:
+		// Not PartiQL: pql executes the literal as a B parameter
+		return "BINARY " + QuoteString(base64.StdEncoding.EncodeToString(t.Value))
+	case *types.AttributeValueMemberBOOL:
+		return strconv.FormatBool(t.Value)
+	case *types.AttributeValueMemberNULL:
+		return "NULL"
+	case *types.AttributeValueMemberSS:
+		arr := make([]string, len(t.Value))
+		for idx, v := range t.Value {
+			arr[idx] = QuoteString(v)
+		}
+		return "<<" + strings.Join(arr, ", ") + ">>"
+	case *types.AttributeValueMemberNS:
+		return "<<" + strings.Join(t.Value, ", ") + ">>"
+	case *types.AttributeValueMemberBS:
+		arr := make([]string, len(t.Value))
+		for idx, v := range t.Value {
+			arr[idx] = "BINARY " + QuoteString(base64.StdEncoding.EncodeToString(v))
+		}
+		return "<<" + strings.Join(arr, ", ") + ">>"
+	case *types.AttributeValueMemberL:
+		arr := make([]string, len(t.Value))
+		for idx, v := range t.Value {
+			arr[idx] = AVToPartiQL(v)
+		}
+		return "[" + strings.Join(arr, ", ") + "]"
+	case *types.AttributeValueMemberM:
+		keys := make([]string, 0, len(t.Value))
+		for k := range t.Value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		arr := make([]string, len(keys))
+		for idx, k := range keys {
+			arr[idx] = QuoteString(k) + " : " + AVToPartiQL(t.Value[k])
+		}
+		return "{" + strings.Join(arr, ", ") + "}"
+	}
+	return "NULL"
+}
+
+// QuoteString renders a string as a single quoted PartiQL string literal
+func QuoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
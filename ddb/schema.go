@@ -0,0 +1,92 @@
+package ddb
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"sync"
+)
+
+// KeySchema is the primary key of a table
+type KeySchema struct {
+	Table     string
+	HashKey   string
+	RangeKey  string // Empty if the table has no sort key
+	HashType  types.ScalarAttributeType
+	RangeType types.ScalarAttributeType
+}
+
+// Names returns the key attribute names, hash key first
+func (k *KeySchema) Names() []string {
+	if k.RangeKey == "" {
+		return []string{k.HashKey}
+	}
+	return []string{k.HashKey, k.RangeKey}
+}
+
+// Type returns the scalar type of a key attribute
+func (k *KeySchema) Type(name string) types.ScalarAttributeType {
+	if name == k.RangeKey {
+		return k.RangeType
+	}
+	return k.HashType
+}
+
+// Schemas looks up table key schemas with DescribeTable, caching the result (or failure) per table
+type Schemas struct {
+	client *dynamodb.Client
+	lock   *sync.Mutex
+	tables map[string]*schemaResult
+}
+
+type schemaResult struct {
+	once   sync.Once
+	schema *KeySchema
+	err    error
+}
+
+func NewSchemas(client *dynamodb.Client) *Schemas {
+	var l sync.Mutex
+	return &Schemas{
+		client: client,
+		lock:   &l,
+		tables: make(map[string]*schemaResult),
+	}
+}
+
+// Get returns the key schema of a table, describing it on first use
+func (s *Schemas) Get(table string) (*KeySchema, error) {
+	s.lock.Lock()
+	r, ok := s.tables[table]
+	if !ok {
+		r = &schemaResult{}
+		s.tables[table] = r
+	}
+	s.lock.Unlock()
+	r.once.Do(func() {
+		r.schema, r.err = s.describe(table)
+	})
+	return r.schema, r.err
+}
+
+func (s *Schemas) describe(table string) (*KeySchema, error) {
+	out, err := s.client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{TableName: &table})
+	if err != nil {
+		return nil, err
+	}
+	attrTypes := make(map[string]types.ScalarAttributeType)
+	for _, ad := range out.Table.AttributeDefinitions {
+		attrTypes[*ad.AttributeName] = ad.AttributeType
+	}
+	k := &KeySchema{Table: table}
+	for _, ks := range out.Table.KeySchema {
+		if ks.KeyType == types.KeyTypeHash {
+			k.HashKey = *ks.AttributeName
+			k.HashType = attrTypes[k.HashKey]
+		} else {
+			k.RangeKey = *ks.AttributeName
+			k.RangeType = attrTypes[k.RangeKey]
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"pql/cli"
+	"pql/config"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	// The "pql describe" command, which prints the status, size, keys and indexes of tables
+	describeCommand = &cli.Command{
+		Name:    "describe",
+		Summary: "Print the status, size, keys and indexes of tables",
+		Args:    "table1 [table2 .... tableN]",
+		Define:  defineDescribe,
+		Run:     runDescribe,
+	}
+
+	describeConn cli.Connection
+	describeJSON bool
+)
+
+func defineDescribe(fs *flag.FlagSet) {
+	describeConn.Flags(fs)
+	fs.BoolVar(&describeJSON, "json", false, "Specify to print the full table descriptions as JSON")
+}
+
+func runDescribe(fs *flag.FlagSet) {
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: No tables specified\n")
+		os.Exit(-9)
+	}
+	client := describeConn.Client()
+	failed := 0
+	for _, name := range fs.Args() {
+		table := config.TableName(name)
+		out, err := client.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: &table})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to describe table %s: %s\n", table, err.Error())
+			failed++
+			continue
+		}
+		if describeJSON {
+			b, _ := json.Marshal(out.Table)
+			fmt.Println(string(b))
+			continue
+		}
+		printTable(out.Table)
+	}
+	if failed > 0 {
+		os.Exit(-9)
+	}
+}
+
+// printTable prints the description of a table as aligned name/value lines
+func printTable(t *types.TableDescription) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Table:\t%s\n", deref(t.TableName))
+	fmt.Fprintf(w, "Status:\t%s\n", t.TableStatus)
+	fmt.Fprintf(w, "Items:\t%d\n", t.ItemCount)
+	fmt.Fprintf(w, "Size:\t%d bytes\n", t.TableSizeBytes)
+	billing := types.BillingModeProvisioned
+	if t.BillingModeSummary != nil {
+		billing = t.BillingModeSummary.BillingMode
+	}
+	fmt.Fprintf(w, "Billing:\t%s\n", billing)
+	if billing == types.BillingModeProvisioned && t.ProvisionedThroughput != nil {
+		fmt.Fprintf(w, "Capacity:\trcu=%d, wcu=%d\n", deref64(t.ProvisionedThroughput.ReadCapacityUnits), deref64(t.ProvisionedThroughput.WriteCapacityUnits))
+	}
+	fmt.Fprintf(w, "Key:\t%s\n", keySchema(t.KeySchema, t.AttributeDefinitions))
+	for _, idx := range t.GlobalSecondaryIndexes {
+		fmt.Fprintf(w, "GSI:\t%s %s (%s)\n", deref(idx.IndexName), keySchema(idx.KeySchema, t.AttributeDefinitions), idx.IndexStatus)
+	}
+	for _, idx := range t.LocalSecondaryIndexes {
+		fmt.Fprintf(w, "LSI:\t%s %s\n", deref(idx.IndexName), keySchema(idx.KeySchema, t.AttributeDefinitions))
+	}
+	if t.StreamSpecification != nil && t.StreamSpecification.StreamEnabled != nil && *t.StreamSpecification.StreamEnabled {
+		fmt.Fprintf(w, "Stream:\t%s\n", t.StreamSpecification.StreamViewType)
+	}
+	fmt.Fprintf(w, "\n")
+	w.Flush()
+}
+
+// keySchema formats a key schema as its attributes with their types, e.g. accountID:S(HASH), createdWhen:S(RANGE)
+func keySchema(keys []types.KeySchemaElement, attrs []types.AttributeDefinition) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		attrType := ""
+		for _, a := range attrs {
+			if deref(a.AttributeName) == deref(k.AttributeName) {
+				attrType = ":" + string(a.AttributeType)
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%s%s(%s)", deref(k.AttributeName), attrType, k.KeyType))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func deref64(n *int64) int64 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
@@ -0,0 +1,141 @@
+package executor
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingBatch fills batches in input order. DynamoDB rejects a BatchExecuteStatement that writes the same
+// item twice, so a statement for an item already in the batch is moved to a later batch, which waits for
+// the batch before it to complete so the statements for the item are still applied in input order.
+type pendingBatch struct {
+	lock     *sync.Mutex // Held while filling or flushing, which flushWhenIdle does from its own goroutine
+	x        *Executor
+	entries  []*batchEntry
+	keys     map[string]bool
+	deferred []keyedEntry
+	moved    int
+	added    int             // The statements added, for telling when a streamed input has gone idle
+	after    <-chan struct{} // Closed once the batch holding the earlier statements for the batch's items completes
+	submit   batchSubmitter
+}
+
+// batchSubmitter executes a batch once after is closed, or straight away if it is nil, returning a channel
+// that is closed once the batch completes
+type batchSubmitter func(entries []*batchEntry, after <-chan struct{}) <-chan struct{}
+
+// keyedEntry is a statement along with the item it writes, or an empty key if that cannot be determined
+type keyedEntry struct {
+	entry *batchEntry
+	key   string
+}
+
+func newPendingBatch(x *Executor, submit batchSubmitter) *pendingBatch {
+	var l sync.Mutex
+	return &pendingBatch{
+		lock:    &l,
+		x:       x,
+		entries: make([]*batchEntry, 0, MAX_BATCH_SIZE),
+		keys:    make(map[string]bool, MAX_BATCH_SIZE),
+		submit:  submit,
+	}
+}
+
+// Add appends a statement to the batch, submitting the batch once it is full
+func (b *pendingBatch) Add(e *batchEntry) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.added++
+	b.x.substitute(e)
+	key := ""
+	if _, k, err := entryKey(b.x.schemas, e); err == nil {
+		key = k.String()
+	}
+	if key != "" && b.keys[key] {
+		b.moved++
+	}
+	b.add(keyedEntry{entry: e, key: key})
+}
+
+func (b *pendingBatch) add(ke keyedEntry) {
+	if ke.key != "" && b.keys[ke.key] {
+		b.deferred = append(b.deferred, ke)
+		if len(b.deferred) >= MAX_BATCH_SIZE {
+			b.flush()
+		}
+		return
+	}
+	b.entries = append(b.entries, ke.entry)
+	if ke.key != "" {
+		b.keys[ke.key] = true
+	}
+	if len(b.entries) == MAX_BATCH_SIZE {
+		b.flush()
+	}
+}
+
+// flush submits the batch and starts the next one with the statements moved out of it, which waits for
+// this one to complete. The lock must be held.
+func (b *pendingBatch) flush() {
+	if len(b.entries) > 0 {
+		done := b.submit(b.entries, b.after)
+		b.entries = make([]*batchEntry, 0, MAX_BATCH_SIZE)
+		b.keys = make(map[string]bool, MAX_BATCH_SIZE)
+		b.after = nil
+		if len(b.deferred) > 0 {
+			b.after = done
+		}
+	}
+	deferred := b.deferred
+	b.deferred = nil
+	for _, ke := range deferred {
+		b.add(ke)
+	}
+}
+
+// FlushAll submits the batch and every statement moved out of it
+func (b *pendingBatch) FlushAll() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.flushAll()
+}
+
+func (b *pendingBatch) flushAll() {
+	for len(b.entries) > 0 || len(b.deferred) > 0 {
+		b.flush()
+	}
+}
+
+// flushWhenIdle submits the batch whenever no statement has been added for a period, until stop is closed,
+// so statements trickling in on stdin or a pipe do not wait for a full batch. The returned channel is closed
+// once it has stopped.
+func (b *pendingBatch) flushWhenIdle(period time.Duration, stop <-chan struct{}) <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		seen := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			b.lock.Lock()
+			if b.added == seen {
+				b.flushAll()
+			}
+			seen = b.added
+			b.lock.Unlock()
+		}
+	}()
+	return stopped
+}
+
+// Moved returns the number of statements moved to a later batch
+func (b *pendingBatch) Moved() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.moved
+}
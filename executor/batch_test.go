@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strings"
+	"testing"
+)
+
+// submittedBatch is a batch passed to the submitter, with whether it waits for the batch before it
+type submittedBatch struct {
+	statements []string
+	waits      bool
+}
+
+// fillBatches adds the statements to a pending batch and returns the batches it submits
+func fillBatches(t *testing.T, entries ...*batchEntry) ([]submittedBatch, int) {
+	t.Helper()
+	db := newFakeDynamoDB(t)
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 1})
+	batches := make([]submittedBatch, 0, 4)
+	b := newPendingBatch(x, func(entries []*batchEntry, after <-chan struct{}) <-chan struct{} {
+		s := submittedBatch{statements: make([]string, len(entries)), waits: after != nil}
+		for idx, e := range entries {
+			s.statements[idx] = *e.request.Statement
+		}
+		batches = append(batches, s)
+		return make(chan struct{})
+	})
+	for _, e := range entries {
+		b.Add(e)
+	}
+	b.FlushAll()
+	return batches, b.Moved()
+}
+
+func entryOf(text string, params ...types.AttributeValue) *batchEntry {
+	return &batchEntry{request: types.BatchStatementRequest{Statement: aws.String(text), Parameters: params}}
+}
+
+func TestBatchSplitsWritesOfTheSameItem(t *testing.T) {
+	batches, moved := fillBatches(t,
+		entryOf(`UPDATE "t" SET v = 1 WHERE pk = 'a'`),
+		entryOf(`UPDATE "t" SET v = 1 WHERE pk = 'b'`),
+		// The same item, written with a placeholder and with the key condition the other way round
+		entryOf(`UPDATE "t" SET v = 2 WHERE pk = ?`, &types.AttributeValueMemberS{Value: "a"}),
+		entryOf(`DELETE FROM "t" WHERE 'a' = pk`),
+		entryOf(`UPDATE "t" SET v = 2 WHERE pk = 'b'`),
+	)
+	if moved != 3 {
+		t.Errorf("Moved() = %d, want 3", moved)
+	}
+	want := []string{"v = 1 WHERE pk = 'a'|v = 1 WHERE pk = 'b'", "pk = ?|v = 2 WHERE pk = 'b'", "'a' = pk"}
+	if len(batches) != len(want) {
+		t.Fatalf("batches = %v, want %d", batches, len(want))
+	}
+	for idx, batch := range batches {
+		parts := strings.Split(want[idx], "|")
+		if len(batch.statements) != len(parts) {
+			t.Fatalf("batch %d = %q, want %q", idx, batch.statements, parts)
+		}
+		for i, part := range parts {
+			if !strings.Contains(batch.statements[i], part) {
+				t.Errorf("batch %d statement %d = %q, want %q", idx, i, batch.statements[i], part)
+			}
+		}
+		// Each moved batch waits for the one it was moved out of
+		if batch.waits != (idx > 0) {
+			t.Errorf("batch %d waits = %v", idx, batch.waits)
+		}
+	}
+}
+
+func TestBatchKeepsStatementsWithoutAKey(t *testing.T) {
+	// Without the full key the item cannot be told apart, so identical statements stay in one batch
+	batches, moved := fillBatches(t,
+		entryOf(`UPDATE "t" SET v = 1 WHERE v = 0`),
+		entryOf(`UPDATE "t" SET v = 1 WHERE v = 0`),
+		entryOf(`UPDATE "t" SET v = 1 WHERE pk = ?`),
+		entryOf(`UPDATE "t" SET v = 1 WHERE pk = ?`),
+	)
+	if moved != 0 || len(batches) != 1 || len(batches[0].statements) != 4 || batches[0].waits {
+		t.Errorf("moved=%d, batches=%v, want one batch of 4", moved, batches)
+	}
+}
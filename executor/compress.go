@@ -0,0 +1,165 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"pql/util"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+
+	GZIP_EXTENSION = ".gz"
+	ZSTD_EXTENSION = ".zst"
+
+	// The read buffer in front of a decompressor, large enough to peek at the magic bytes
+	DECOMPRESS_BUFFER_SIZE = 64 * 1024
+)
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress returns a reader of r that decompresses gzip or zstd content, detected by its leading bytes,
+// along with the compression detected ("" if the content is not compressed). Concatenated gzip members
+// and zstd frames are read as one stream.
+func Decompress(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReaderSize(r, DECOMPRESS_BUFFER_SIZE)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case util.IsGzipped(magic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, COMPRESSION_GZIP, err
+		}
+		return zr, COMPRESSION_GZIP, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, COMPRESSION_ZSTD, err
+		}
+		return zr.IOReadCloser(), COMPRESSION_ZSTD, nil
+	}
+	return io.NopCloser(br), "", nil
+}
+
+// inputFile is an opened input, decompressed if need be, which closes the file along with the decompressor
+type inputFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (i *inputFile) Close() error {
+	i.ReadCloser.Close()
+	if i.file == os.Stdin {
+		return nil
+	}
+	return i.file.Close()
+}
+
+// OpenInput opens an input file, or stdin for the "-" input name, decompressing gzip or zstd content
+func OpenInput(fileName string) (io.ReadCloser, error) {
+	file := os.Stdin
+	if fileName != STDIN_NAME {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	r, _, err := Decompress(file)
+	if err != nil {
+		closeFile(file)
+		return nil, err
+	}
+	return &inputFile{ReadCloser: r, file: file}, nil
+}
+
+// CompressionOf returns the compression of an output file named with a .gz or .zst extension, or ""
+func CompressionOf(fileName string) string {
+	switch {
+	case strings.HasSuffix(fileName, GZIP_EXTENSION):
+		return COMPRESSION_GZIP
+	case strings.HasSuffix(fileName, ZSTD_EXTENSION):
+		return COMPRESSION_ZSTD
+	}
+	return ""
+}
+
+// OutputFile is a buffered output file, compressed with gzip or zstd when it is named with a .gz or .zst
+// extension
+type OutputFile struct {
+	file   *os.File
+	writer *bufio.Writer
+	zw     compressor
+}
+
+// compressor is implemented by both the gzip and zstd writers
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CreateOutput creates an output file, compressed according to its extension
+func CreateOutput(fileName string) (*OutputFile, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	o := &OutputFile{file: f}
+	switch CompressionOf(fileName) {
+	case COMPRESSION_GZIP:
+		o.zw = gzip.NewWriter(f)
+	case COMPRESSION_ZSTD:
+		if o.zw, err = zstd.NewWriter(f, zstd.WithEncoderConcurrency(1)); err != nil {
+			closeFile(f)
+			return nil, err
+		}
+	}
+	if o.zw != nil {
+		o.writer = bufio.NewWriter(o.zw)
+	} else {
+		o.writer = bufio.NewWriter(f)
+	}
+	return o, nil
+}
+
+func (o *OutputFile) Name() string {
+	return o.file.Name()
+}
+
+func (o *OutputFile) Write(p []byte) (int, error) {
+	return o.writer.Write(p)
+}
+
+// Flush writes the buffered output through to the file, so it can be read while it is still being written
+func (o *OutputFile) Flush() error {
+	if err := o.writer.Flush(); err != nil {
+		return err
+	}
+	if o.zw != nil {
+		return o.zw.Flush()
+	}
+	return nil
+}
+
+// Close flushes the output, ends the compressed stream and closes the file
+func (o *OutputFile) Close() error {
+	err := o.writer.Flush()
+	if o.zw != nil {
+		if zerr := o.zw.Close(); err == nil {
+			err = zerr
+		}
+	}
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package executor
+
+import (
+	"fmt"
+	"log"
+	"pql/ddb"
+	"pql/statement"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often written dead letters are flushed through to the file, so it can be read while the run is going
+const DEAD_LETTER_FLUSH_INTERVAL = 5 * time.Second
+
+// DeadLetter writes statements that could not be executed to a file, each preceded by a comment
+// recording where it came from and why it failed, so the file can be passed straight back to pql.
+// The file is compressed when it is named with a .gz or .zst extension.
+type DeadLetter struct {
+	fileName string
+	writer   *OutputFile
+	lock     *sync.Mutex
+	count    int
+	dirty    bool          // Statements have been written since the last flush
+	done     chan struct{} // Closed to stop the timed flushes
+	stopped  chan struct{} // Closed once the timed flushes have stopped
+}
+
+func NewDeadLetter(fileName string) (*DeadLetter, error) {
+	if o, err := CreateOutput(fileName); err != nil {
+		return nil, err
+	} else {
+		var l sync.Mutex
+		d := &DeadLetter{
+			fileName: fileName,
+			writer:   o,
+			lock:     &l,
+			done:     make(chan struct{}),
+			stopped:  make(chan struct{}),
+		}
+		go d.flushEvery(DEAD_LETTER_FLUSH_INTERVAL)
+		return d, nil
+	}
+}
+
+// Write records a failed statement. A nil DeadLetter discards it.
+func (d *DeadLetter) Write(e *batchEntry, code, message string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.writeEntry(e, code, message)
+}
+
+// WriteTransaction records the statements of a failed transaction, with the error for each statement,
+// inside a BEGIN TRANSACTION ... COMMIT block so they are retried together. A nil DeadLetter discards them.
+func (d *DeadLetter) WriteTransaction(entries []*batchEntry, codes, messages []string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	fmt.Fprintf(d.writer, "BEGIN TRANSACTION;\n")
+	for idx, e := range entries {
+		d.writeEntry(e, codes[idx], messages[idx])
+	}
+	fmt.Fprintf(d.writer, "COMMIT;\n")
+}
+
+// WriteInvalid records an input that could not be turned into a statement, as a comment.
+// A nil DeadLetter discards it.
+func (d *DeadLetter) WriteInvalid(fileName string, line int, code, message, raw string) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	fmt.Fprintf(d.writer, "-- file=%s, line=%d, code=%s, error=%s\n", fileName, line, code, singleLine(message))
+	fmt.Fprintf(d.writer, "-- %s\n", singleLine(raw))
+	d.count++
+	d.dirty = true
+}
+
+func (d *DeadLetter) writeEntry(e *batchEntry, code, message string) {
+	fmt.Fprintf(d.writer, "-- file=%s, line=%d, code=%s, error=%s\n", e.fileName, e.line, code, singleLine(message))
+	fmt.Fprintf(d.writer, "%s;\n", boundStatement(e))
+	d.count++
+	d.dirty = true
+}
+
+// flushEvery flushes the statements written since the last flush, every period until the file is closed.
+// Flushing a compressed stream ends a block, so it is not done after every statement.
+func (d *DeadLetter) flushEvery(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer func() {
+		ticker.Stop()
+		close(d.stopped)
+	}()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.lock.Lock()
+			if d.dirty {
+				d.dirty = false
+				if err := d.writer.Flush(); err != nil {
+					log.Printf("WARNING: Failed to write dead letter: file=%s, error=%s\n", d.fileName, err.Error())
+				}
+			}
+			d.lock.Unlock()
+		}
+	}
+}
+
+// Close flushes and closes the dead letter file
+func (d *DeadLetter) Close() {
+	if d == nil {
+		return
+	}
+	// Stop the timed flushes first, so none can run once the file is closed
+	close(d.done)
+	<-d.stopped
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.writer.Close(); err != nil {
+		log.Printf("WARNING: Failed to close dead letter file: file=%s, error=%s\n", d.fileName, err.Error())
+	}
+	log.Printf("Dead Letters: file=%s, statements=%d\n", d.fileName, d.count)
+}
+
+// boundStatement returns the statement with any parameters inlined as literals, so it can be re-executed on its own
+func boundStatement(e *batchEntry) string {
+	if len(e.request.Parameters) == 0 {
+		return *e.request.Statement
+	}
+	literals := make([]string, len(e.request.Parameters))
+	for idx, av := range e.request.Parameters {
+		literals[idx] = ddb.AVToPartiQL(av)
+	}
+	if bound, err := statement.Bind(*e.request.Statement, literals); err == nil {
+		return bound
+	}
+	return *e.request.Statement
+}
+
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
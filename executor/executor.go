@@ -0,0 +1,637 @@
+package executor
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/panjf2000/ants/v2"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"pql/ddb"
+	"pql/metrics"
+	"pql/pqlfaker"
+	"pql/ratelimit"
+	"pql/statement"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MAX_BATCH_SIZE = 25
+	// The input name for reading statements from stdin
+	STDIN_NAME = "-"
+	// The error code of the statements failed because the context was done before they were executed
+	ERROR_INTERRUPTED = "Interrupted"
+	// How long a partial batch read from stdin or a pipe waits for more statements before it is executed
+	STREAM_IDLE_FLUSH = 200 * time.Millisecond
+)
+
+var (
+	ONE       = int32(1)
+	MINUS_ONE = int32(-1)
+
+	// The error codes of requests rejected for exceeding provisioned or account throughput
+	throttleCodes = map[string]bool{
+		"ProvisionedThroughputExceededException": true,
+		"ThrottlingException":                    true,
+		"RequestLimitExceeded":                   true,
+	}
+)
+
+// Options configures an Executor. Only Client is required.
+type Options struct {
+	Client      *dynamodb.Client
+	Concurrency int // The number of batches executed in parallel (defaults to 10 per CPU)
+	MaxRetries  int // The maximum number of retries for a throttled statement (0 or less for infinite)
+	NoExec      bool
+	Ordered     bool // Execute statements for the same item in input order
+
+	Faker *pqlfaker.Faker
+	Seed  int64 // The seed each statement's faker values are derived from
+	Echo  io.Writer
+	// The input names in the order they were passed, so a statement's faker values depend on its input's
+	// position rather than on how its path was typed
+	Inputs []string
+
+	WCU float64 // The optional target write capacity units consumed per second
+	RPS float64 // The optional target statements executed per second
+
+	// The optional statement with ? placeholders executed once per row of CSV or JSONL data inputs
+	Statement  string
+	Columns    []string
+	DataFormat string
+
+	// The optional source of the writer for the results of the SELECT statements in an input, which is
+	// called with the input's name on its first SELECT and closed once the input is complete
+	SelectOutput func(name string) (io.WriteCloser, error)
+
+	DeadLetter *DeadLetter
+	Journal    *Journal
+	Undo       *Undo
+
+	BatchLatency       *metrics.Histogram
+	TransactionLatency *metrics.Histogram
+}
+
+// Executor executes PartiQL statements read from pql files, data files or memory in parallel batches.
+// It is safe to execute several inputs at once, and they share the pool, rate limits and stats.
+type Executor struct {
+	opts       Options
+	client     *dynamodb.Client
+	pool       *ants.Pool
+	schemas    *ddb.Schemas
+	wcuLimiter *ratelimit.Limiter
+	rpsLimiter *ratelimit.Limiter
+	echoLock   *sync.Mutex
+	tables     *tableReport
+	inputLock  *sync.Mutex
+	inputs     []*input       // The inputs being executed
+	fakers     *sync.Pool     // Fakers for the pool goroutines, reseeded for each statement
+	inputIndex map[string]int // The position of each of the Inputs
+
+	rowsFailed      *int32
+	batchesFailed   *int32
+	executed        *int32
+	retries         *int32
+	inFlight        *int32
+	capUsed         *int64
+	executedBatches *int32
+}
+
+// batchEntry is a statement queued for execution, along with the input location it was read from
+type batchEntry struct {
+	request     types.BatchStatementRequest
+	in          *input
+	fileName    string
+	line        int
+	endLine     int
+	seq         int
+	undo        string // The compensating statement, when Undo is set
+	undoItem    uint64 // The hash of the key of the item the compensating statement restores
+	captured    bool
+	substituted bool
+	key         *tableKey // The table and operation for the TableStats, once classified
+	parsed      bool      // Whether the statement has been parsed into stmt and parseErr
+	stmt        *statement.Parsed
+	parseErr    error
+}
+
+// parse returns the parsed statement, parsing it on first use so the batching, undo capture and table stats
+// share one parse. Entries are parsed as they are built, once the faker values are substituted.
+func (e *batchEntry) parse() (*statement.Parsed, error) {
+	if !e.parsed {
+		e.stmt, e.parseErr = statement.Parse(*e.request.Statement)
+		e.parsed = true
+	}
+	return e.stmt, e.parseErr
+}
+
+func New(opts Options) (*Executor, error) {
+	if opts.Client == nil {
+		return nil, errors.New("A DynamoDB client is required")
+	}
+	if opts.DataFormat != "" && opts.DataFormat != DATA_FORMAT_CSV && opts.DataFormat != DATA_FORMAT_JSONL {
+		return nil, errors.New("Invalid data format: " + opts.DataFormat)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = runtime.NumCPU() * 10
+	}
+	pool, err := ants.NewPool(opts.Concurrency, ants.WithPreAlloc(true))
+	if err != nil {
+		return nil, err
+	}
+	var l, il sync.Mutex
+	x := &Executor{
+		opts:            opts,
+		client:          opts.Client,
+		pool:            pool,
+		schemas:         ddb.NewSchemas(opts.Client),
+		echoLock:        &l,
+		tables:          newTableReport(),
+		inputLock:       &il,
+		rowsFailed:      new(int32),
+		batchesFailed:   new(int32),
+		executed:        new(int32),
+		retries:         new(int32),
+		inFlight:        new(int32),
+		capUsed:         new(int64),
+		executedBatches: new(int32),
+	}
+	if opts.Faker != nil {
+		x.fakers = &sync.Pool{New: func() interface{} {
+			return opts.Faker.WithSeed(opts.Seed)
+		}}
+		x.inputIndex = make(map[string]int, len(opts.Inputs))
+		for idx := len(opts.Inputs) - 1; idx >= 0; idx-- {
+			x.inputIndex[opts.Inputs[idx]] = idx
+		}
+	}
+	if opts.WCU > 0 {
+		x.wcuLimiter = ratelimit.NewLimiter(opts.WCU)
+	}
+	if opts.RPS > 0 {
+		x.rpsLimiter = ratelimit.NewLimiter(opts.RPS)
+	}
+	return x, nil
+}
+
+// Close releases the pool. The dead letter, journal and undo files are left for the caller to close.
+func (x *Executor) Close() {
+	x.pool.Release()
+}
+
+// ExecuteFile executes the statements in the named pql file, or the rows of the named data file when a
+// Statement is configured. The "-" name reads stdin.
+func (x *Executor) ExecuteFile(ctx context.Context, fileName string) (*Result, error) {
+	file, err := OpenInput(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return x.executeReader(ctx, fileName, file, isStream(fileName))
+}
+
+// isStream returns true if the named input is stdin or a pipe, whose statements may arrive slowly
+func isStream(fileName string) bool {
+	if fileName == STDIN_NAME {
+		return true
+	}
+	info, err := os.Stat(fileName)
+	return err == nil && !info.Mode().IsRegular()
+}
+
+// ExecuteReader executes the statements, or data rows, read from r, which may be gzip or zstd compressed.
+// The name identifies the input in logs, the dead letter and undo files and the journal.
+func (x *Executor) ExecuteReader(ctx context.Context, name string, r io.Reader) (*Result, error) {
+	dr, _, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	return x.executeReader(ctx, name, dr, true)
+}
+
+func (x *Executor) executeReader(ctx context.Context, name string, r io.Reader, stream bool) (*Result, error) {
+	in := newInput(name)
+	in.stream = stream
+	var source statementSource = scriptSource{statement.NewScanner(r)}
+	if x.opts.Statement != "" {
+		if d, err := x.newDataSource(r, in); err != nil {
+			return nil, err
+		} else {
+			source = d
+		}
+	}
+	return x.execute(ctx, in, source)
+}
+
+// ExecuteStatements executes the passed statements, one per element, which may include the break,
+// BEGIN TRANSACTION and COMMIT directives. Line numbers in the result are element positions (1 based).
+func (x *Executor) ExecuteStatements(ctx context.Context, name string, statements ...string) (*Result, error) {
+	return x.execute(ctx, newInput(name), newSliceSource(statements))
+}
+
+// execute reads the statements from the source and submits them in batches and transactions, returning
+// once every submitted statement has completed. Reading stops when the context is done.
+func (x *Executor) execute(ctx context.Context, in *input, source statementSource) (*Result, error) {
+	fileName := in.name
+	x.started(in)
+	defer x.finished(in)
+	var lanes *orderedLanes
+	if x.opts.Ordered {
+		lanes = newOrderedLanes(ctx, x, x.opts.Concurrency)
+	}
+	var fileWg sync.WaitGroup
+	batch := newPendingBatch(x, func(arrCopy []*batchEntry, after <-chan struct{}) <-chan struct{} {
+		done := make(chan struct{})
+		fileWg.Add(1)
+		x.goInPool(func() {
+			defer fileWg.Done()
+			defer close(done)
+			if after != nil {
+				// The batch holds statements moved out of the batch before it, which must be applied first
+				<-after
+			}
+			x.submitBatch(ctx, arrCopy)
+		})
+		return done
+	})
+	if in.stream && lanes == nil {
+		// The ordered lanes execute what they have as soon as nothing else is queued
+		stop := make(chan struct{})
+		stopped := batch.flushWhenIdle(STREAM_IDLE_FLUSH, stop)
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+	// txn is non-nil while inside a BEGIN TRANSACTION ... COMMIT block
+	var txn []*batchEntry
+	txnLine := 0
+	for source.Scan() {
+		st := source.Statement()
+		in.read(st)
+		if ctx.Err() != nil {
+			in.stoppedLine = st.Line
+			if txn != nil {
+				log.Printf("WARNING: Transaction not executed on shutdown: file=%s, line=%d\n", fileName, txnLine)
+				in.stoppedLine = txnLine
+				txn = nil
+			}
+			break
+		}
+		switch st.Kind {
+		case statement.KindBreak:
+			if txn != nil {
+				log.Printf("WARNING: Ignoring break inside transaction: file=%s, line=%d\n", fileName, st.Line)
+			} else if lanes != nil {
+				lanes.Barrier()
+			} else {
+				// The statements after a break are applied after everything before it
+				batch.FlushAll()
+				fileWg.Wait()
+			}
+			continue
+		case statement.KindBegin:
+			if txn != nil {
+				x.failTransaction(txn, "InvalidTransaction", fmt.Sprintf("BEGIN TRANSACTION on line %d has no COMMIT before the next BEGIN TRANSACTION on line %d", txnLine, st.Line))
+			}
+			batch.FlushAll()
+			txn = make([]*batchEntry, 0, MAX_TRANSACTION_SIZE)
+			txnLine = st.Line
+			continue
+		case statement.KindCommit:
+			if txn == nil {
+				log.Printf("WARNING: Ignoring COMMIT without BEGIN TRANSACTION: file=%s, line=%d\n", fileName, st.Line)
+				continue
+			}
+			txnCopy := txn
+			txn = nil
+			if len(txnCopy) > MAX_TRANSACTION_SIZE {
+				x.failTransaction(txnCopy, "InvalidTransaction", fmt.Sprintf("BEGIN TRANSACTION on line %d has %d statements, the maximum is %d", txnLine, len(txnCopy), MAX_TRANSACTION_SIZE))
+			} else if len(txnCopy) > 0 && lanes != nil {
+				// The transaction may write items queued on any lane
+				lanes.Barrier()
+				x.runInPool(func() {
+					x.submitTransaction(ctx, txnCopy)
+				})
+			} else if len(txnCopy) > 0 {
+				fileWg.Add(1)
+				x.goInPool(func() {
+					defer fileWg.Done()
+					x.submitTransaction(ctx, txnCopy)
+				})
+			}
+			continue
+		}
+		in.statements++
+		if x.opts.Journal.IsCompleted(fileName, st.Line) {
+			in.skipped++
+			continue
+		}
+		e := &batchEntry{
+			request: types.BatchStatementRequest{
+				Statement:  aws.String(st.Text),
+				Parameters: source.Parameters(),
+			},
+			in:       in,
+			fileName: fileName,
+			line:     st.Line,
+			endLine:  st.EndLine,
+			seq:      st.Seq,
+		}
+		if err := bindBinaries(e); err != nil {
+			x.fail(e, string(types.BatchStatementErrorCodeEnumValidationError), err.Error())
+			continue
+		}
+		// The faker values are substituted first, so the statement is parsed once with its final text
+		x.substitute(e)
+		e.parse()
+		if txn != nil {
+			txn = append(txn, e)
+			continue
+		}
+		if isSelect(st.Text) {
+			// A SELECT sees the writes before it, and the statements after it wait for it
+			if lanes != nil {
+				lanes.Barrier()
+			} else {
+				batch.FlushAll()
+				fileWg.Wait()
+			}
+			x.runInPool(func() {
+				x.submitSelect(ctx, e)
+			})
+			continue
+		}
+		if lanes != nil {
+			lanes.Add(e)
+			continue
+		}
+		batch.Add(e)
+	}
+	err := source.Err()
+	if txn != nil {
+		x.failTransaction(txn, "InvalidTransaction", fmt.Sprintf("BEGIN TRANSACTION on line %d has no COMMIT", txnLine))
+	}
+	batch.FlushAll()
+	if lanes != nil {
+		lanes.Close()
+	}
+	fileWg.Wait()
+	in.closeOutput()
+	in.moved = batch.Moved()
+	if in.skipped > 0 {
+		log.Printf("Skipped Completed Statements: file=%s, statements=%d\n", fileName, in.skipped)
+	}
+	if in.moved > 0 {
+		log.Printf("Duplicate Items Moved To Later Batches: file=%s, statements=%d\n", fileName, in.moved)
+	}
+	log.Printf("File Processing Complete: %s\n", fileName)
+	return in.result(), err
+}
+
+// submitBatch executes a batch, retrying throttled statements. Each attempt records the statements it
+// settled in the journal, those that succeeded or failed with an error that a re-run would not fix, so a
+// batch that fails part way is not re-executed in full on resume. The rate limit waits and retry backoff end
+// when the context is done, failing the statements that are left.
+func (x *Executor) submitBatch(ctx context.Context, batch []*batchEntry) {
+	arrCopy := batch
+	retryCount := 0
+	atomic.AddInt32(x.inFlight, ONE)
+	defer func() {
+		atomic.AddInt32(x.inFlight, MINUS_ONE)
+		if retryCount > 0 {
+			atomic.AddInt32(x.retries, int32(retryCount))
+		}
+	}()
+
+	for {
+		failedCommands, err := x.executeBatch(ctx, arrCopy)
+		if err != nil {
+			// Whole batch failed, not cap related
+			atomic.AddInt32(x.batchesFailed, ONE)
+			code, message := ErrorCode(err)
+			for _, e := range arrCopy {
+				x.fail(e, code, message)
+			}
+			break
+		} else {
+			if failedCommands != nil && len(failedCommands) > 0 {
+				retryCount++
+				x.tables.retried(failedCommands)
+				if x.opts.MaxRetries > 0 {
+					if retryCount > x.opts.MaxRetries {
+						// Retries Exhausted, fail all rows
+						for _, e := range failedCommands {
+							x.fail(e, string(types.BatchStatementErrorCodeEnumThrottlingError), fmt.Sprintf("Retries exhausted: retries=%d", x.opts.MaxRetries))
+						}
+						break
+					}
+				}
+				// Retries not exhausted yet, or retrying indefinitely
+				if err := ratelimit.Sleep(ctx, ratelimit.Backoff(retryCount)); err != nil {
+					code, message := ErrorCode(err)
+					for _, e := range failedCommands {
+						x.fail(e, code, message)
+					}
+					break
+				}
+				arrCopy = failedCommands
+				continue
+			} else {
+				// All rows executed
+				break
+			}
+		}
+	}
+	atomic.AddInt32(x.executedBatches, ONE)
+	return
+}
+
+// executeBatch executes the passed batch, counting the statements that succeeded or failed outright (which are
+// written to the dead letter file) and journaling them, and returning the statements that were throttled and
+// should be retried
+func (x *Executor) executeBatch(ctx context.Context, entries []*batchEntry) (capFailedCommands []*batchEntry, err error) {
+	failedArr := make([]*batchEntry, 0)
+	for _, e := range entries {
+		x.substitute(e)
+	}
+	if x.opts.NoExec {
+		x.succeeded(entries)
+		return nil, nil
+	}
+	if err := x.opts.Undo.Capture(ctx, x.client, x.schemas, entries); err != nil {
+		if isThrottle(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	commands := make([]types.BatchStatementRequest, len(entries))
+	for idx, e := range entries {
+		commands[idx] = e.request
+	}
+	estimate := float64(len(commands))
+	if err := x.rpsLimiter.Wait(ctx, estimate); err != nil {
+		return nil, err
+	}
+	if err := x.wcuLimiter.Wait(ctx, estimate); err != nil {
+		return nil, err
+	}
+	var totalCap = int64(0)
+	var totalUnits = float64(0)
+	startTime := time.Now()
+	defer x.opts.BatchLatency.ObserveSince(startTime)
+	// A request already being sent is completed rather than cancelled, so its outcome is known
+	out, batchErr := x.client.BatchExecuteStatement(context.TODO(), &dynamodb.BatchExecuteStatementInput{
+		Statements:             commands,
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+	})
+	elapsed := time.Since(startTime)
+	if batchErr != nil {
+		x.tables.call(entries, elapsed, 0)
+		if isThrottle(batchErr) {
+			// Retry the whole batch like throttled statements
+			x.rpsLimiter.Throttled()
+			x.wcuLimiter.Throttled()
+			return entries, nil
+		}
+		return nil, batchErr
+	} else {
+		if len(out.ConsumedCapacity) > 0 {
+			for _, cc := range out.ConsumedCapacity {
+				if cc.CapacityUnits != nil {
+					totalCap += int64(*cc.CapacityUnits)
+					totalUnits += *cc.CapacityUnits
+				}
+			}
+		}
+		x.wcuLimiter.Adjust(totalUnits - estimate)
+		x.tables.call(entries, elapsed, totalUnits)
+		succeeded := make([]*batchEntry, 0, len(entries))
+		settled := make([]*batchEntry, 0, len(entries))
+		for idx, rez := range out.Responses {
+			if rez.Error != nil {
+				if rez.Error.Code == types.BatchStatementErrorCodeEnumThrottlingError {
+					failedArr = append(failedArr, entries[idx])
+					continue
+				}
+				x.fail(entries[idx], string(rez.Error.Code), aws.ToString(rez.Error.Message))
+			} else {
+				x.opts.Undo.Write(entries[idx])
+				succeeded = append(succeeded, entries[idx])
+			}
+			settled = append(settled, entries[idx])
+		}
+		x.succeeded(succeeded)
+		x.opts.Journal.Record(settled)
+		if len(failedArr) > 0 {
+			x.rpsLimiter.Throttled()
+			x.wcuLimiter.Throttled()
+		} else {
+			x.rpsLimiter.Succeeded()
+			x.wcuLimiter.Succeeded()
+		}
+
+	}
+	atomic.AddInt64(x.capUsed, totalCap)
+	return failedArr, nil
+}
+
+// substitute replaces the faker symbols in a queued statement, if it has not been done already, and echoes
+// the statement when faker is enabled or it will not be executed
+func (x *Executor) substitute(e *batchEntry) {
+	if e.substituted {
+		return
+	}
+	e.substituted = true
+	if x.opts.Faker != nil {
+		fk := x.fakers.Get().(*pqlfaker.Faker)
+		fk.Reseed(x.statementSeed(e))
+		e.request.Statement = fk.Substitute(e.request.Statement)
+		x.fakers.Put(fk)
+	}
+	if x.opts.Echo != nil && (x.opts.Faker != nil || x.opts.NoExec) {
+		x.echoLock.Lock()
+		fmt.Fprintf(x.opts.Echo, "%s\n", boundStatement(e))
+		x.echoLock.Unlock()
+	}
+}
+
+// statementSeed derives the faker seed for a statement from the Seed and the statement's place in its input,
+// so each statement generates the same data however the statements are scheduled across the pool. The input
+// is identified by its base name and its position in the Inputs (-1 if it is not one of them), so the same
+// file passed as "./a.pql" or "/data/a.pql" generates the same data.
+func (x *Executor) statementSeed(e *batchEntry) int64 {
+	position, ok := x.inputIndex[e.fileName]
+	if !ok {
+		position = -1
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, x.opts.Seed)
+	h.Write([]byte(filepath.Base(e.fileName)))
+	binary.Write(h, binary.LittleEndian, int64(position))
+	binary.Write(h, binary.LittleEndian, int64(e.seq))
+	return int64(h.Sum64())
+}
+
+// goInPool executes fx on the pool, or on the calling goroutine if the pool rejects it, e.g. once it is
+// released, so fx always runs and its statements are always accounted for
+func (x *Executor) goInPool(fx func()) {
+	if err := x.pool.Submit(fx); err != nil {
+		log.Printf("WARNING: Pool rejected task, executing it on the calling goroutine: error=%s\n", err.Error())
+		fx()
+	}
+}
+
+// runInPool executes fx on the pool and waits for it to complete
+func (x *Executor) runInPool(fx func()) {
+	done := make(chan struct{})
+	x.goInPool(func() {
+		defer close(done)
+		fx()
+	})
+	<-done
+}
+
+// isThrottle returns true if a failed request was rejected for exceeding throughput limits, including
+// when the SDK has given up retrying it. Other errors the SDK gave up on, e.g. network errors and server
+// errors, are not retried again.
+func isThrottle(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return throttleCodes[apiErr.ErrorCode()]
+	}
+	return false
+}
+
+// ErrorCode returns the DynamoDB error code and message for a failed request
+func ErrorCode(err error) (string, string) {
+	if errors.Is(err, context.Canceled) {
+		return ERROR_INTERRUPTED, "Shutdown before the statement was executed"
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode(), apiErr.ErrorMessage()
+	}
+	return "RequestFailed", err.Error()
+}
+
+func closeFile(file *os.File) {
+	if file != nil {
+		err := file.Close()
+		if err != nil {
+			log.Printf("WARNING: Failed to close file: file=%s, error=%s\n", file.Name(), err.Error())
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDynamoDB serves the DynamoDB calls the executor makes, for a table "t" keyed by the string "pk",
+// recording the statements it applies in the order they are applied
+type fakeDynamoDB struct {
+	server *httptest.Server
+	lock   *sync.Mutex
+	// The optional delay before applying a call's statements
+	delay   func(statements []string) time.Duration
+	applied []string
+	calls   map[string]int
+	// The optional items returned by BatchGetItem, by their pk
+	items map[string]map[string]interface{}
+}
+
+func newFakeDynamoDB(t *testing.T) *fakeDynamoDB {
+	var l sync.Mutex
+	f := &fakeDynamoDB{
+		lock:  &l,
+		calls: make(map[string]int),
+		items: make(map[string]map[string]interface{}),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeDynamoDB) client() *dynamodb.Client {
+	return dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("x", "y", ""),
+		EndpointResolver: dynamodb.EndpointResolverFromURL(f.server.URL),
+		Retryer:          aws.NopRetryer{},
+	})
+}
+
+func (f *fakeDynamoDB) serve(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	var req struct {
+		Statements         []struct{ Statement string }
+		TransactStatements []struct{ Statement string }
+		RequestItems       map[string]struct {
+			Keys []map[string]map[string]string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	statements := make([]string, 0, len(req.Statements)+len(req.TransactStatements))
+	for _, s := range append(req.Statements, req.TransactStatements...) {
+		statements = append(statements, s.Statement)
+	}
+	if f.delay != nil {
+		time.Sleep(f.delay(statements))
+	}
+	f.lock.Lock()
+	f.calls[op]++
+	f.applied = append(f.applied, statements...)
+	f.lock.Unlock()
+
+	var resp interface{}
+	switch op {
+	case "DescribeTable":
+		resp = map[string]interface{}{"Table": map[string]interface{}{
+			"TableName":            "t",
+			"KeySchema":            []interface{}{map[string]string{"AttributeName": "pk", "KeyType": "HASH"}},
+			"AttributeDefinitions": []interface{}{map[string]string{"AttributeName": "pk", "AttributeType": "S"}},
+		}}
+	case "BatchExecuteStatement":
+		responses := make([]interface{}, len(statements))
+		for idx := range responses {
+			responses[idx] = map[string]interface{}{}
+		}
+		resp = map[string]interface{}{"Responses": responses}
+	case "BatchGetItem":
+		found := make([]interface{}, 0)
+		f.lock.Lock()
+		for _, keys := range req.RequestItems {
+			for _, key := range keys.Keys {
+				if item, ok := f.items[key["pk"]["S"]]; ok {
+					found = append(found, item)
+				}
+			}
+		}
+		f.lock.Unlock()
+		resp = map[string]interface{}{"Responses": map[string]interface{}{"t": found}}
+	default:
+		resp = map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// appliedIndex returns the position the statement containing text was applied at, or -1
+func (f *fakeDynamoDB) appliedIndex(text string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for idx, s := range f.applied {
+		if strings.Contains(s, text) {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (f *fakeDynamoDB) callCount(op string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[op]
+}
+
+func newTestExecutor(t *testing.T, opts Options) *Executor {
+	x, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	t.Cleanup(x.Close)
+	return x
+}
+
+func TestDuplicateItemAppliedAfterEarlierBatch(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	// Hold back the batch with the first write, so a moved statement racing ahead of it is applied first
+	db.delay = func(statements []string) time.Duration {
+		for _, s := range statements {
+			if strings.Contains(s, "SET v = 'first'") {
+				return 200 * time.Millisecond
+			}
+		}
+		return 0
+	}
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 4})
+	statements := []string{
+		`UPDATE "t" SET v = 'first' WHERE pk = 'dup'`,
+		`UPDATE "t" SET v = 'second' WHERE pk = 'dup'`,
+	}
+	for idx := 0; idx < 10; idx++ {
+		statements = append(statements, fmt.Sprintf(`UPDATE "t" SET v = 'other' WHERE pk = 'k%d'`, idx))
+	}
+	res, err := x.ExecuteStatements(context.Background(), "dup", statements...)
+	if err != nil {
+		t.Fatalf("ExecuteStatements() = %v", err)
+	}
+	if res.Moved != 1 || res.Executed != len(statements) {
+		t.Fatalf("moved=%d, executed=%d, want 1 and %d", res.Moved, res.Executed, len(statements))
+	}
+	first, second := db.appliedIndex("'first'"), db.appliedIndex("'second'")
+	if first == -1 || second < first {
+		t.Errorf("moved statement applied at %d, before the statement it was moved behind at %d", second, first)
+	}
+}
+
+func TestReleasedPoolStillExecutesStatements(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 2})
+	x.Close()
+	res, err := x.ExecuteStatements(context.Background(), "released",
+		`UPDATE "t" SET v = 1 WHERE pk = 'a'`,
+		"BEGIN TRANSACTION",
+		`UPDATE "t" SET v = 2 WHERE pk = 'b'`,
+		"COMMIT",
+		`SELECT * FROM "t" WHERE pk = 'a'`,
+	)
+	if err != nil {
+		t.Fatalf("ExecuteStatements() = %v", err)
+	}
+	if res.Executed != 3 || res.Failed != 0 {
+		t.Errorf("executed=%d, failed=%d, want 3 and 0", res.Executed, res.Failed)
+	}
+}
+
+func TestStreamedPartialBatchExecutedWhenIdle(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 2})
+	r, w := io.Pipe()
+	done := make(chan *Result, 1)
+	go func() {
+		res, _ := x.ExecuteReader(context.Background(), "stream", r)
+		done <- res
+	}()
+	fmt.Fprintf(w, "UPDATE \"t\" SET v = 1 WHERE pk = 'a';\nUPDATE \"t\" SET v = 1 WHERE pk = 'b';\n")
+	// The pipe stays open, so the two statements are only executed if the idle partial batch is
+	deadline := time.Now().Add(5 * time.Second)
+	for db.appliedIndex("pk = 'b'") == -1 {
+		if time.Now().After(deadline) {
+			t.Fatal("partial batch not executed while the stream was idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Fprintf(w, "UPDATE \"t\" SET v = 2 WHERE pk = 'a';\n")
+	w.Close()
+	if res := <-done; res.Executed != 3 {
+		t.Errorf("executed=%d, want 3", res.Executed)
+	}
+}
@@ -0,0 +1,202 @@
+package executor
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JournalEntry records a range of input lines whose statements have all been executed
+type JournalEntry struct {
+	File       string    `json:"file"`
+	From       int       `json:"from"`
+	To         int       `json:"to"`
+	Statements int       `json:"statements"`
+	Completed  time.Time `json:"completed"`
+}
+
+// Journal appends a record of each completed batch to a file so an interrupted run can be resumed
+// without re-executing the statements that were already applied
+type Journal struct {
+	fileName  string
+	file      *os.File
+	lock      *sync.Mutex
+	completed map[string][]lineRange // The sorted, merged ranges completed by previous runs of each input
+}
+
+// lineRange is a range of input lines, inclusive
+type lineRange struct {
+	from, to int
+}
+
+// NewJournal opens the named journal file. When resume is true, the existing entries are loaded and
+// new entries are appended, otherwise the journal is started afresh.
+func NewJournal(fileName string, resume bool) (*Journal, error) {
+	completed := make(map[string][]lineRange)
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if entries, err := loadJournal(fileName); err != nil {
+			return nil, err
+		} else {
+			for _, e := range entries {
+				completed[e.File] = append(completed[e.File], lineRange{from: e.From, to: e.To})
+			}
+			for name, ranges := range completed {
+				completed[name] = mergeRanges(ranges)
+			}
+			log.Printf("Journal Loaded: file=%s, entries=%d\n", fileName, len(entries))
+		}
+		flags = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	}
+	f, err := os.OpenFile(fileName, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if resume {
+		if err := terminateLastLine(f); err != nil {
+			closeFile(f)
+			return nil, err
+		}
+	}
+	var l sync.Mutex
+	return &Journal{
+		fileName:  fileName,
+		file:      f,
+		lock:      &l,
+		completed: completed,
+	}, nil
+}
+
+func loadJournal(fileName string) ([]JournalEntry, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closeFile(f)
+	entries := make([]JournalEntry, 0, 1024)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A partially written last line from a crashed run
+			log.Printf("WARNING: Skipping invalid journal entry: file=%s, entry=%s\n", fileName, scanner.Text())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// terminateLastLine ends a partially written last line left by a crashed run, so the entries appended
+// after it are not joined to it and lost on the next resume
+func terminateLastLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// IsCompleted returns true if the statement starting on the passed line of the passed input was
+// recorded as completed by a previous run. A nil Journal has no completed statements.
+func (j *Journal) IsCompleted(fileName string, line int) bool {
+	if j == nil {
+		return false
+	}
+	ranges := j.completed[journalKey(fileName)]
+	idx := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].to >= line
+	})
+	return idx < len(ranges) && ranges[idx].from <= line
+}
+
+// mergeRanges sorts ranges by their first line and merges those that overlap or are adjacent, so a line
+// can be looked up with a binary search
+func mergeRanges(ranges []lineRange) []lineRange {
+	sort.Slice(ranges, func(a, b int) bool {
+		return ranges[a].from < ranges[b].from
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if last := len(merged) - 1; last >= 0 && r.from <= merged[last].to+1 {
+			if r.to > merged[last].to {
+				merged[last].to = r.to
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Record appends the line ranges covered by the settled statements of a batch. Statements moved between batches
+// and statements still being retried break the batch into several ranges, so ranges are split wherever the
+// statement sequence is not contiguous.
+func (j *Journal) Record(entries []*batchEntry) {
+	if j == nil || len(entries) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	ranges := make([]JournalEntry, 0, 1)
+	var curr *JournalEntry
+	lastSeq := 0
+	for _, e := range entries {
+		if curr == nil || e.fileName != curr.File || e.seq != lastSeq+1 {
+			ranges = append(ranges, JournalEntry{File: e.fileName, From: e.line, Completed: now})
+			curr = &ranges[len(ranges)-1]
+		}
+		curr.To = e.endLine
+		curr.Statements++
+		lastSeq = e.seq
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, r := range ranges {
+		r.File = journalKey(r.File)
+		if b, err := json.Marshal(r); err == nil {
+			if _, err := j.file.Write(append(b, '\n')); err != nil {
+				log.Printf("WARNING: Failed to write journal: file=%s, error=%s\n", j.fileName, err.Error())
+			}
+		}
+	}
+}
+
+// FileName returns the name of the journal file
+func (j *Journal) FileName() string {
+	return j.fileName
+}
+
+// Close closes the journal file
+func (j *Journal) Close() {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	closeFile(j.file)
+}
+
+func journalKey(fileName string) string {
+	if fileName == STDIN_NAME {
+		return fileName
+	}
+	if abs, err := filepath.Abs(fileName); err == nil {
+		return abs
+	}
+	return fileName
+}
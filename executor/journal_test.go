@@ -0,0 +1,104 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// resumeJournal opens the journal to resume from, closing it when the test ends
+func resumeJournal(t *testing.T, fileName string) *Journal {
+	t.Helper()
+	j, err := NewJournal(fileName, true)
+	if err != nil {
+		t.Fatalf("NewJournal() = %v", err)
+	}
+	t.Cleanup(j.Close)
+	return j
+}
+
+func TestJournalResumeAfterPartialLastLine(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "run.journal")
+	a := filepath.Join(t.TempDir(), "a.pql")
+	// A run crashed while writing its second entry
+	os.WriteFile(fileName, []byte(`{"file":"`+a+`","from":1,"to":2,"statements":2}`+"\n"+`{"file":"`+a+`","fr`), 0644)
+
+	j := resumeJournal(t, fileName)
+	if !j.IsCompleted(a, 2) || j.IsCompleted(a, 3) {
+		t.Fatalf("IsCompleted(2), IsCompleted(3) = %v, %v, want only the complete entry loaded", j.IsCompleted(a, 2), j.IsCompleted(a, 3))
+	}
+	j.Record([]*batchEntry{{fileName: a, line: 3, endLine: 3, seq: 3}})
+	j.Close()
+
+	// The entry recorded after the partial line must survive the next resume
+	if again := resumeJournal(t, fileName); !again.IsCompleted(a, 3) {
+		t.Error("entry appended after a partial line was lost")
+	}
+}
+
+func TestJournalMatchesInputsByAbsolutePath(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	fileName := filepath.Join(dir, "run.journal")
+	j, err := NewJournal(fileName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Record([]*batchEntry{{fileName: "a.pql", line: 1, endLine: 1, seq: 1}, {fileName: STDIN_NAME, line: 1, endLine: 1, seq: 1}})
+	j.Close()
+
+	resumed := resumeJournal(t, fileName)
+	if !resumed.IsCompleted(filepath.Join(dir, "a.pql"), 1) || !resumed.IsCompleted("./a.pql", 1) {
+		t.Error("a.pql not matched by its absolute or ./ relative path")
+	}
+	if !resumed.IsCompleted(STDIN_NAME, 1) {
+		t.Error("stdin not matched by its name")
+	}
+}
+
+func TestJournalSplitsRangesAtSettledGaps(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "run.journal")
+	j, err := NewJournal(fileName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Statement 3 (lines 4-5) is still being retried, so the batch's lines 1-8 are not one range
+	j.Record([]*batchEntry{
+		{fileName: "a.pql", line: 1, endLine: 1, seq: 1},
+		{fileName: "a.pql", line: 2, endLine: 3, seq: 2},
+		{fileName: "a.pql", line: 6, endLine: 6, seq: 4},
+		{fileName: "b.pql", line: 1, endLine: 1, seq: 1},
+		{fileName: "a.pql", line: 7, endLine: 8, seq: 5},
+	})
+	j.Close()
+
+	resumed := resumeJournal(t, fileName)
+	for line, want := range map[int]bool{1: true, 3: true, 4: false, 5: false, 6: true, 8: true, 9: false} {
+		if got := resumed.IsCompleted("a.pql", line); got != want {
+			t.Errorf("IsCompleted(a.pql, %d) = %v, want %v", line, got, want)
+		}
+	}
+	if got := resumed.completed[journalKey("a.pql")]; !reflect.DeepEqual(got, []lineRange{{1, 3}, {6, 8}}) {
+		t.Errorf("completed ranges = %v, want adjacent ranges merged to [{1 3} {6 8}]", got)
+	}
+}
+
+func TestJournalStartedAfreshWithoutResume(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "run.journal")
+	os.WriteFile(fileName, []byte(`{"file":"-","from":1,"to":9,"statements":9}`+"\n"), 0644)
+	j, err := NewJournal(fileName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if resumeJournal(t, fileName).IsCompleted(STDIN_NAME, 1) {
+		t.Error("entries of the previous run kept without resume")
+	}
+	var none *Journal
+	if none.IsCompleted(STDIN_NAME, 1) {
+		t.Error("nil Journal IsCompleted() = true")
+	}
+}
@@ -0,0 +1,90 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"pql/ddb"
+	"pql/statement"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// itemKey identifies the item a statement writes to
+type itemKey struct {
+	schema *ddb.KeySchema
+	key    map[string]types.AttributeValue
+}
+
+// String returns the table and key values, for comparing the items written by two statements
+func (k *itemKey) String() string {
+	var b strings.Builder
+	b.WriteString(k.schema.Table)
+	for _, name := range k.schema.Names() {
+		b.WriteString("|")
+		b.WriteString(ddb.AVToPartiQL(k.key[name]))
+	}
+	return b.String()
+}
+
+// where returns a WHERE clause matching the key
+func (k *itemKey) where() string {
+	conds := make([]string, 0, 2)
+	for _, name := range k.schema.Names() {
+		conds = append(conds, fmt.Sprintf("%s = %s", quoteName(name), ddb.AVToPartiQL(k.key[name])))
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// entryKey parses a queued statement and resolves the primary key of the item it writes to, from its
+// WHERE clause or INSERT document and any bound parameters
+func entryKey(schemas *ddb.Schemas, e *batchEntry) (*statement.Parsed, *itemKey, error) {
+	p, err := e.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !p.Quoted && p.Index != "" {
+		return p, nil, errors.New("Table name " + p.TableName() + " must be double quoted")
+	}
+	schema, err := schemas.Get(p.Table)
+	if err != nil {
+		return p, nil, err
+	}
+	values, ok := p.Key(schema.Names()...)
+	if !ok {
+		return p, nil, errors.New("Statement does not constrain the full primary key of " + p.Table)
+	}
+	k := &itemKey{schema: schema, key: make(map[string]types.AttributeValue, len(values))}
+	for idx, name := range schema.Names() {
+		av, err := keyValue(values[idx], e.request.Parameters, schema.Type(name))
+		if err != nil {
+			return p, nil, err
+		}
+		k.key[name] = av
+	}
+	return p, k, nil
+}
+
+// keyValue converts a key value from a statement to an AttributeValue of the key's type
+func keyValue(v statement.Value, params []types.AttributeValue, kind types.ScalarAttributeType) (types.AttributeValue, error) {
+	if v.Param > 0 {
+		if v.Param > len(params) {
+			return nil, errors.New(fmt.Sprintf("No parameter bound to placeholder %d", v.Param))
+		}
+		return params[v.Param-1], nil
+	}
+	switch {
+	case kind == types.ScalarAttributeTypeS && v.IsString():
+		return &types.AttributeValueMemberS{Value: v.String()}, nil
+	case kind == types.ScalarAttributeTypeN && !v.IsString():
+		if _, err := ddb.ToNumberOrErr(v.Text); err == nil {
+			return &types.AttributeValueMemberN{Value: v.Text}, nil
+		}
+	}
+	return nil, errors.New("Unsupported key value: " + v.Text)
+}
+
+// quoteName double quotes an attribute name for use in a statement
+func quoteName(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
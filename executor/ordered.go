@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// orderedLanes routes statements to a fixed number of lanes by the item they write. Each lane executes
+// its batches one at a time, so statements for the same item are applied in input order while statements
+// for other items run in parallel on the other lanes.
+type orderedLanes struct {
+	ctx   context.Context
+	x     *Executor
+	lanes []chan laneOp
+	wg    *sync.WaitGroup
+}
+
+// laneOp is a statement for a lane to execute, or a barrier to flush and report back on
+type laneOp struct {
+	entry   *batchEntry
+	key     string
+	barrier *sync.WaitGroup
+}
+
+func newOrderedLanes(ctx context.Context, x *Executor, count int) *orderedLanes {
+	var wg sync.WaitGroup
+	o := &orderedLanes{
+		ctx:   ctx,
+		x:     x,
+		lanes: make([]chan laneOp, count),
+		wg:    &wg,
+	}
+	for idx := range o.lanes {
+		o.lanes[idx] = make(chan laneOp, MAX_BATCH_SIZE)
+		wg.Add(1)
+		go o.run(o.lanes[idx])
+	}
+	return o
+}
+
+// Add queues a statement on the lane for its item. Statements whose item cannot be determined are
+// routed by their text, so only identical statements are ordered.
+func (o *orderedLanes) Add(e *batchEntry) {
+	o.x.substitute(e)
+	key := *e.request.Statement
+	if _, k, err := entryKey(o.x.schemas, e); err == nil {
+		key = k.String()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	o.lanes[h.Sum32()%uint32(len(o.lanes))] <- laneOp{entry: e, key: key}
+}
+
+// Barrier executes everything queued on every lane and waits for it to complete
+func (o *orderedLanes) Barrier() {
+	var wg sync.WaitGroup
+	wg.Add(len(o.lanes))
+	for _, lane := range o.lanes {
+		lane <- laneOp{barrier: &wg}
+	}
+	wg.Wait()
+}
+
+// Close executes everything queued and stops the lanes
+func (o *orderedLanes) Close() {
+	for _, lane := range o.lanes {
+		close(lane)
+	}
+	o.wg.Wait()
+}
+
+func (o *orderedLanes) run(lane chan laneOp) {
+	defer o.wg.Done()
+	batch := make([]*batchEntry, 0, MAX_BATCH_SIZE)
+	keys := make(map[string]bool, MAX_BATCH_SIZE)
+	flush := func() {
+		if len(batch) > 0 {
+			arrCopy := batch
+			batch = make([]*batchEntry, 0, MAX_BATCH_SIZE)
+			keys = make(map[string]bool, MAX_BATCH_SIZE)
+			o.x.runInPool(func() {
+				o.x.submitBatch(o.ctx, arrCopy)
+			})
+		}
+	}
+	for {
+		var op laneOp
+		var ok bool
+		select {
+		case op, ok = <-lane:
+		default:
+			// Nothing else is queued, so execute what has been collected rather than wait for a full batch
+			flush()
+			op, ok = <-lane
+		}
+		if !ok {
+			flush()
+			return
+		}
+		if op.barrier != nil {
+			flush()
+			op.barrier.Done()
+			continue
+		}
+		// A batch cannot order two statements for the same item, so the later one starts the next batch
+		if keys[op.key] {
+			flush()
+		}
+		batch = append(batch, op.entry)
+		keys[op.key] = true
+		if len(batch) == MAX_BATCH_SIZE {
+			flush()
+		}
+	}
+}
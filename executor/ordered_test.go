@@ -0,0 +1,71 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderedLanesApplySameItemInInputOrder(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	// Earlier writes of item a take longer, so any of them executed alongside a later one is applied after it
+	db.delay = func(statements []string) time.Duration {
+		for _, s := range statements {
+			var v int
+			if _, err := fmt.Sscanf(s, `UPDATE "t" SET v = %d WHERE pk = 'a'`, &v); err == nil {
+				return time.Duration(6-v) * 30 * time.Millisecond
+			}
+		}
+		return 0
+	}
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 4, Ordered: true})
+	statements := make([]string, 0, 20)
+	for v := 1; v <= 5; v++ {
+		statements = append(statements, fmt.Sprintf(`UPDATE "t" SET v = %d WHERE pk = 'a'`, v))
+		for idx := 0; idx < 3; idx++ {
+			statements = append(statements, fmt.Sprintf(`UPDATE "t" SET v = %d WHERE pk = 'k%d'`, v, idx))
+		}
+	}
+	res, err := x.ExecuteStatements(context.Background(), "ordered", statements...)
+	if err != nil {
+		t.Fatalf("ExecuteStatements() = %v", err)
+	}
+	if res.Executed != len(statements) || res.Moved != 0 {
+		t.Fatalf("executed=%d, moved=%d, want %d and 0", res.Executed, res.Moved, len(statements))
+	}
+	last := -1
+	for v := 1; v <= 5; v++ {
+		idx := db.appliedIndex(fmt.Sprintf("SET v = %d WHERE pk = 'a'", v))
+		if idx < last {
+			t.Fatalf("write %d of item a applied at %d, before the write ahead of it at %d", v, idx, last)
+		}
+		last = idx
+	}
+}
+
+func TestOrderedLanesBreakWaitsForEveryLane(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	db.delay = func(statements []string) time.Duration {
+		for _, s := range statements {
+			if strings.Contains(s, "'slow'") {
+				return 200 * time.Millisecond
+			}
+		}
+		return 0
+	}
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 4, Ordered: true})
+	_, err := x.ExecuteStatements(context.Background(), "break",
+		`UPDATE "t" SET v = 'slow' WHERE pk = 'a'`,
+		"break",
+		`UPDATE "t" SET v = 'after' WHERE pk = 'b'`,
+	)
+	if err != nil {
+		t.Fatalf("ExecuteStatements() = %v", err)
+	}
+	// b is likely on another lane, which must still wait for a before the break
+	if slow, after := db.appliedIndex("'slow'"), db.appliedIndex("'after'"); slow == -1 || after < slow {
+		t.Errorf("statement after the break applied at %d, before the one ahead of it at %d", after, slow)
+	}
+}
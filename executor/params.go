@@ -0,0 +1,392 @@
+package executor
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"io"
+	"log"
+	"path/filepath"
+	"pql/ddb"
+	"pql/statement"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	DATA_FORMAT_CSV   = "csv"
+	DATA_FORMAT_JSONL = "jsonl"
+)
+
+var (
+	csvTypes = map[string]bool{"S": true, "N": true, "B": true, "BOOL": true, "NULL": true, "JSON": true}
+)
+
+// statementSource produces the statements to execute from an input file
+type statementSource interface {
+	Scan() bool
+	Statement() statement.Statement
+	Parameters() []types.AttributeValue
+	Err() error
+}
+
+// scriptSource reads literal statements from a pql file
+type scriptSource struct {
+	*statement.Scanner
+}
+
+func (s scriptSource) Parameters() []types.AttributeValue {
+	return nil
+}
+
+// sliceSource produces one statement or directive per element of a slice
+type sliceSource struct {
+	statements []string
+	idx        int
+	curr       statement.Statement
+}
+
+func newSliceSource(statements []string) *sliceSource {
+	return &sliceSource{statements: statements}
+}
+
+func (s *sliceSource) Scan() bool {
+	for s.idx < len(s.statements) {
+		text := strings.TrimSuffix(strings.TrimSpace(s.statements[s.idx]), ";")
+		s.idx++
+		if text == "" {
+			continue
+		}
+		s.curr = statement.Statement{
+			Kind:    statement.KindOf(text),
+			Text:    text,
+			Line:    s.idx,
+			EndLine: s.idx,
+			Seq:     s.idx,
+		}
+		return true
+	}
+	return false
+}
+
+func (s *sliceSource) Statement() statement.Statement {
+	return s.curr
+}
+
+func (s *sliceSource) Parameters() []types.AttributeValue {
+	return nil
+}
+
+func (s *sliceSource) Err() error {
+	return nil
+}
+
+// dataSource reads rows from a CSV or JSONL data file, producing the Statement for each row with
+// the row's values as its parameters. CSV files start with a header row naming the columns, where a
+// column name may be suffixed with a type (e.g. "zip:S") to override the inferred type. JSONL rows are
+// either arrays of values, or objects whose values are selected by Columns. The values bound to the table's
+// key attributes take the key's type, whatever their content or suffix.
+type dataSource struct {
+	x            *Executor
+	in           *input
+	fileName     string
+	text         string
+	placeholders int
+	format       string
+	reader       *bufio.Reader
+	csvReader    *csv.Reader
+	csvIndexes   []int
+	csvTypes     []string
+	keyTypes     map[int]string // The key attribute type of each placeholder bound to one (1 based)
+	line         int
+	seq          int
+	curr         statement.Statement
+	params       []types.AttributeValue
+	err          error
+}
+
+func (x *Executor) newDataSource(r io.Reader, in *input) (*dataSource, error) {
+	d := &dataSource{
+		x:            x,
+		in:           in,
+		fileName:     in.name,
+		text:         x.opts.Statement,
+		placeholders: statement.Placeholders(x.opts.Statement),
+		keyTypes:     x.paramKeyTypes(x.opts.Statement),
+		reader:       bufio.NewReaderSize(r, 64*1024),
+	}
+	d.format = dataFormat(x.opts.DataFormat, in.name, d.reader)
+	if d.format == DATA_FORMAT_CSV {
+		d.csvReader = csv.NewReader(d.reader)
+		d.csvReader.FieldsPerRecord = -1
+		if header, err := d.csvReader.Read(); err != nil {
+			return nil, errors.New("Failed to read CSV header: " + err.Error())
+		} else {
+			d.line, _ = d.csvReader.FieldPos(0)
+			if err := d.mapColumns(header); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// paramKeyTypes returns the type of the key attribute each placeholder of the statement is bound to, if
+// any, so key values are typed by the table rather than by their content. If the table cannot be described
+// every value's type is inferred.
+func (x *Executor) paramKeyTypes(text string) map[int]string {
+	p, err := statement.Parse(text)
+	if err != nil {
+		return nil
+	}
+	schema, err := x.schemas.Get(p.Table)
+	if err != nil {
+		log.Printf("WARNING: Failed to describe table, inferring the key value types: table=%s, error=%s\n", p.Table, err.Error())
+		return nil
+	}
+	keyTypes := make(map[int]string, 2)
+	for _, name := range schema.Names() {
+		if values, ok := p.Key(name); ok && values[0].Param > 0 {
+			keyTypes[values[0].Param] = string(schema.Type(name))
+		}
+	}
+	return keyTypes
+}
+
+// keyAV converts a JSON value bound to a key attribute to the key's type, e.g. a number to an S key
+func keyAV(av types.AttributeValue, keyType string) (types.AttributeValue, error) {
+	switch t := av.(type) {
+	case *types.AttributeValueMemberN:
+		if keyType == "S" {
+			return &types.AttributeValueMemberS{Value: t.Value}, nil
+		}
+	case *types.AttributeValueMemberS:
+		if keyType != "S" {
+			return ddb.StringToAV(t.Value, keyType)
+		}
+	}
+	return av, nil
+}
+
+// dataFormat returns the data format if one was specified, otherwise the format implied by the file's
+// extension, otherwise JSONL if the content starts with a JSON array or object, or CSV if not
+func dataFormat(dataFormatName, fileName string, r *bufio.Reader) string {
+	if dataFormatName != "" {
+		return strings.ToLower(dataFormatName)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		return DATA_FORMAT_CSV
+	case ".jsonl", ".ndjson", ".json":
+		return DATA_FORMAT_JSONL
+	}
+	if b, err := r.Peek(1); err == nil && (b[0] == '[' || b[0] == '{') {
+		return DATA_FORMAT_JSONL
+	}
+	return DATA_FORMAT_CSV
+}
+
+// mapColumns resolves the CSV columns bound to the statement, in order, from the header row
+func (d *dataSource) mapColumns(header []string) error {
+	names := make([]string, len(header))
+	colTypes := make([]string, len(header))
+	for idx, h := range header {
+		names[idx] = strings.TrimSpace(h)
+		if pos := strings.LastIndex(names[idx], ":"); pos != -1 && csvTypes[strings.ToUpper(names[idx][pos+1:])] {
+			colTypes[idx] = names[idx][pos+1:]
+			names[idx] = names[idx][:pos]
+		}
+	}
+	columns := d.x.opts.Columns
+	if len(columns) == 0 {
+		d.csvIndexes = make([]int, len(header))
+		for idx := range header {
+			d.csvIndexes[idx] = idx
+		}
+		d.csvTypes = colTypes
+		return nil
+	}
+	d.csvIndexes = make([]int, len(columns))
+	d.csvTypes = make([]string, len(columns))
+	for idx, col := range columns {
+		found := false
+		for pos, name := range names {
+			if name == col {
+				d.csvIndexes[idx] = pos
+				d.csvTypes[idx] = colTypes[pos]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Column [" + col + "] is not in the CSV header")
+		}
+	}
+	return nil
+}
+
+// Scan reads the next valid row. Invalid rows are reported and skipped.
+func (d *dataSource) Scan() bool {
+	for {
+		values, raw, err := d.readRow()
+		if err == io.EOF {
+			return false
+		}
+		if err == nil && len(values) != d.placeholders {
+			err = errors.New(fmt.Sprintf("Row has %d values but the statement has %d placeholders", len(values), d.placeholders))
+		}
+		if err != nil {
+			if d.err != nil {
+				return false
+			}
+			d.x.invalidRow(d.in, d.line, raw, err)
+			continue
+		}
+		d.seq++
+		d.curr = statement.Statement{
+			Kind:    statement.KindStatement,
+			Text:    d.text,
+			Line:    d.line,
+			EndLine: d.line,
+			Seq:     d.seq,
+		}
+		d.params = values
+		return true
+	}
+}
+
+// readRow returns the values of the next row, and the raw row for error reporting
+func (d *dataSource) readRow() ([]types.AttributeValue, string, error) {
+	if d.format == DATA_FORMAT_CSV {
+		record, err := d.csvReader.Read()
+		if err == io.EOF {
+			return nil, "", err
+		}
+		if err != nil {
+			if pe, ok := err.(*csv.ParseError); ok {
+				d.line = pe.StartLine
+			} else {
+				d.err = err
+			}
+			return nil, strings.Join(record, ","), err
+		}
+		// Quoted fields can span lines, so the line is where the record starts rather than a count of records
+		d.line, _ = d.csvReader.FieldPos(0)
+		raw := strings.Join(record, ",")
+		values := make([]types.AttributeValue, len(d.csvIndexes))
+		for idx, pos := range d.csvIndexes {
+			if pos >= len(record) {
+				return nil, raw, errors.New(fmt.Sprintf("Row has %d columns, the header has more", len(record)))
+			}
+			typeName := d.csvTypes[idx]
+			if keyType, ok := d.keyTypes[idx+1]; ok {
+				typeName = keyType
+			}
+			if av, err := ddb.StringToAV(record[pos], typeName); err != nil {
+				return nil, raw, err
+			} else {
+				values[idx] = av
+			}
+		}
+		return values, raw, nil
+	}
+	for {
+		line, err := d.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			d.err = err
+			return nil, "", err
+		}
+		if len(line) == 0 && err == io.EOF {
+			return nil, "", io.EOF
+		}
+		d.line++
+		raw := strings.TrimSpace(line)
+		if raw == "" {
+			if err == io.EOF {
+				return nil, "", io.EOF
+			}
+			continue
+		}
+		values, rowErr := jsonRowValues(raw, d.x.opts.Columns)
+		for idx := range values {
+			if keyType, ok := d.keyTypes[idx+1]; ok && rowErr == nil {
+				values[idx], rowErr = keyAV(values[idx], keyType)
+			}
+		}
+		return values, raw, rowErr
+	}
+}
+
+func jsonRowValues(raw string, columns []string) ([]types.AttributeValue, error) {
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	var row interface{}
+	if err := decoder.Decode(&row); err != nil {
+		return nil, errors.New("Invalid JSON row: " + err.Error())
+	}
+	switch t := row.(type) {
+	case []interface{}:
+		values := make([]types.AttributeValue, len(t))
+		for idx, v := range t {
+			values[idx] = ddb.ToAV(v)
+		}
+		return values, nil
+	case map[string]interface{}:
+		if len(columns) == 0 {
+			return nil, errors.New("JSON object rows require -columns to order their values")
+		}
+		values := make([]types.AttributeValue, len(columns))
+		for idx, col := range columns {
+			values[idx] = ddb.ToAV(t[col])
+		}
+		return values, nil
+	}
+	return nil, errors.New("JSON rows must be an array or an object")
+}
+
+func (d *dataSource) Statement() statement.Statement {
+	return d.curr
+}
+
+func (d *dataSource) Parameters() []types.AttributeValue {
+	return d.params
+}
+
+func (d *dataSource) Err() error {
+	return d.err
+}
+
+// invalidRow reports a data row that cannot be bound to the statement
+func (x *Executor) invalidRow(in *input, line int, raw string, err error) {
+	log.Printf("ERROR: Invalid data row: file=%s, line=%d, error=%s\n", in.name, line, err.Error())
+	atomic.AddInt32(x.rowsFailed, ONE)
+	x.tables.failed(classify(x.opts.Statement), "InvalidRow")
+	in.fail(Failure{Name: in.name, Line: line, Statement: raw, Code: "InvalidRow", Message: err.Error()})
+	x.opts.DeadLetter.WriteInvalid(in.name, line, "InvalidRow", err.Error(), raw)
+}
+
+// bindBinaries moves the BINARY '<base64>' literals of a statement, as written to undo and dead letter
+// files, to B parameters, between the parameters it already has
+func bindBinaries(e *batchEntry) error {
+	text, values, err := statement.Binaries(*e.request.Statement)
+	if err != nil || values == nil {
+		return err
+	}
+	params := make([]types.AttributeValue, 0, len(e.request.Parameters)+len(values))
+	next := 0
+	for idx := 0; idx < len(e.request.Parameters)+len(values); idx++ {
+		if value, ok := values[idx]; ok {
+			params = append(params, &types.AttributeValueMemberB{Value: value})
+		} else if next < len(e.request.Parameters) {
+			params = append(params, e.request.Parameters[next])
+			next++
+		}
+	}
+	e.request.Statement = aws.String(text)
+	e.request.Parameters = params
+	return nil
+}
@@ -0,0 +1,135 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"io"
+	"log"
+	"pql/ddb"
+	"pql/ratelimit"
+	"pql/statement"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// isSelect returns true if the statement is a SELECT query
+func isSelect(text string) bool {
+	fields := strings.Fields(text)
+	return len(fields) > 0 && strings.EqualFold(fields[0], statement.OP_SELECT)
+}
+
+// submitSelect executes a SELECT, paging through the results and writing each item to the input's
+// SELECT output. Reads from a table are consistent, so a SELECT sees the writes that completed before it,
+// while reads from an index, which cannot be consistent, may not.
+func (x *Executor) submitSelect(ctx context.Context, e *batchEntry) {
+	atomic.AddInt32(x.inFlight, ONE)
+	defer atomic.AddInt32(x.inFlight, MINUS_ONE)
+	x.substitute(e)
+	if x.opts.NoExec {
+		return
+	}
+	w, err := e.in.selectOutput(x.opts.SelectOutput)
+	if err != nil {
+		x.fail(e, "OutputFailed", err.Error())
+		return
+	}
+	consistent := true
+	if p, err := e.parse(); err == nil && p.Index != "" {
+		consistent = false
+	}
+	fmt.Fprintf(w, "-- file=%s, line=%d: %s\n", e.fileName, e.line, singleLine(boundStatement(e)))
+	rows := 0
+	retryCount := 0
+	defer func() {
+		if retryCount > 0 {
+			atomic.AddInt32(x.retries, int32(retryCount))
+		}
+	}()
+	var nextToken *string
+	for {
+		if err := x.rpsLimiter.Wait(ctx, 1); err != nil {
+			code, message := ErrorCode(err)
+			x.fail(e, code, message)
+			return
+		}
+		startTime := time.Now()
+		out, err := x.client.ExecuteStatement(context.TODO(), &dynamodb.ExecuteStatementInput{
+			Statement:              e.request.Statement,
+			Parameters:             e.request.Parameters,
+			ConsistentRead:         aws.Bool(consistent),
+			NextToken:              nextToken,
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		})
+		units := float64(0)
+		if err == nil && out.ConsumedCapacity != nil && out.ConsumedCapacity.CapacityUnits != nil {
+			units = *out.ConsumedCapacity.CapacityUnits
+		}
+		x.tables.call([]*batchEntry{e}, time.Since(startTime), units)
+		if err != nil {
+			if isThrottle(err) {
+				x.rpsLimiter.Throttled()
+				retryCount++
+				x.tables.retried([]*batchEntry{e})
+				if x.opts.MaxRetries <= 0 || retryCount <= x.opts.MaxRetries {
+					serr := ratelimit.Sleep(ctx, ratelimit.Backoff(retryCount))
+					if serr == nil {
+						continue
+					}
+					err = serr
+				}
+			}
+			code, message := ErrorCode(err)
+			fmt.Fprintf(w, "-- error=%s: %s\n", code, singleLine(message))
+			log.Printf("Select Failed: file=%s, line=%d, code=%s, error=%s\n", e.fileName, e.line, code, message)
+			x.fail(e, code, message)
+			return
+		}
+		x.rpsLimiter.Succeeded()
+		atomic.AddInt64(x.capUsed, int64(units))
+		for _, item := range out.Items {
+			if b, err := json.Marshal(ddb.ExtractItem(item)); err == nil {
+				fmt.Fprintf(w, "%s\n", string(b))
+			}
+			rows++
+		}
+		if out.NextToken == nil {
+			break
+		}
+		nextToken = out.NextToken
+	}
+	fmt.Fprintf(w, "-- rows=%d\n", rows)
+	atomic.AddInt32(e.in.rows, int32(rows))
+	x.succeeded([]*batchEntry{e})
+	log.Printf("Select Complete: file=%s, line=%d, rows=%d\n", e.fileName, e.line, rows)
+}
+
+// selectOutput returns the writer for the input's SELECT results, opening it on the first SELECT.
+// Results are discarded if there is no output.
+func (in *input) selectOutput(open func(name string) (io.WriteCloser, error)) (io.Writer, error) {
+	if in.output != nil {
+		return in.output, nil
+	}
+	if open == nil {
+		return io.Discard, nil
+	}
+	w, err := open(in.name)
+	if err != nil {
+		return nil, err
+	}
+	in.output = w
+	return w, nil
+}
+
+// closeOutput closes the input's SELECT output, if a SELECT opened one
+func (in *input) closeOutput() {
+	if in.output != nil {
+		if err := in.output.Close(); err != nil {
+			log.Printf("WARNING: Failed to close select output: file=%s, error=%s\n", in.name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package executor
+
+import (
+	"math/rand"
+	"pql/statement"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The latencies kept per table and operation for the percentiles, sampled once there are more
+	MAX_LATENCY_SAMPLES = 10000
+
+	// The classes of error codes, by what it takes to fix them
+	ERROR_CLASS_THROTTLING = "throttling" // Capacity ran out and retries were exhausted, a re-run may succeed
+	ERROR_CLASS_CONDITION  = "condition"  // The item was not in the state the statement required
+	ERROR_CLASS_CONFLICT   = "conflict"   // Another request wrote the item at the same time, a re-run may succeed
+	ERROR_CLASS_INVALID    = "invalid"    // The statement or data is wrong and must be fixed
+	ERROR_CLASS_NOT_FOUND  = "notfound"   // The table or index does not exist
+	ERROR_CLASS_ACCESS     = "access"     // The credentials are missing, expired or not permitted
+	ERROR_CLASS_SERVICE    = "service"    // DynamoDB or the network failed, a re-run may succeed
+	ERROR_CLASS_OTHER      = "other"
+)
+
+var (
+	errorClasses = map[string]string{
+		"ThrottlingError":                 ERROR_CLASS_THROTTLING,
+		"ProvisionedThroughputExceeded":   ERROR_CLASS_THROTTLING,
+		"RequestLimitExceeded":            ERROR_CLASS_THROTTLING,
+		"Throttling":                      ERROR_CLASS_THROTTLING,
+		"ConditionalCheckFailed":          ERROR_CLASS_CONDITION,
+		"TransactionCanceled":             ERROR_CLASS_CONDITION,
+		"TransactionConflict":             ERROR_CLASS_CONFLICT,
+		"TransactionInProgress":           ERROR_CLASS_CONFLICT,
+		"ItemCollectionSizeLimitExceeded": ERROR_CLASS_CONFLICT,
+		"ValidationError":                 ERROR_CLASS_INVALID,
+		"Validation":                      ERROR_CLASS_INVALID,
+		"DuplicateItem":                   ERROR_CLASS_INVALID,
+		"InvalidRow":                      ERROR_CLASS_INVALID,
+		"InvalidTransaction":              ERROR_CLASS_INVALID,
+		"ResourceNotFound":                ERROR_CLASS_NOT_FOUND,
+		"AccessDenied":                    ERROR_CLASS_ACCESS,
+		"UnrecognizedClient":              ERROR_CLASS_ACCESS,
+		"ExpiredToken":                    ERROR_CLASS_ACCESS,
+		"MissingAuthenticationToken":      ERROR_CLASS_ACCESS,
+		"InvalidSignature":                ERROR_CLASS_ACCESS,
+		"InternalServerError":             ERROR_CLASS_SERVICE,
+		"InternalServer":                  ERROR_CLASS_SERVICE,
+		"ServiceUnavailable":              ERROR_CLASS_SERVICE,
+		"RequestFailed":                   ERROR_CLASS_SERVICE,
+	}
+)
+
+// TableStats are the totals of one operation on one table, with the table named as it is in the statements
+type TableStats struct {
+	Table         string         `json:"table"`
+	Op            string         `json:"op"`
+	Executed      int            `json:"executed"`
+	Failed        int            `json:"failed"`
+	Retries       int            `json:"retries"`
+	CapacityUnits float64        `json:"capacityUnits"`
+	Errors        map[string]int `json:"errors,omitempty"` // The failures by DynamoDB (or pql) error code
+	Latency       Latency        `json:"latency"`
+}
+
+// Latency summarizes the DynamoDB calls that included an operation on a table, in milliseconds
+type Latency struct {
+	Calls int     `json:"calls"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+type tableKey struct {
+	table string
+	op    string
+}
+
+type tableCounters struct {
+	executed int
+	failed   int
+	retries  int
+	capacity float64
+	errors   map[string]int
+	calls    int
+	max      float64
+	samples  []float64
+}
+
+// tableReport accumulates the TableStats of an Executor
+type tableReport struct {
+	lock   *sync.Mutex
+	tables map[tableKey]*tableCounters
+}
+
+func newTableReport() *tableReport {
+	var l sync.Mutex
+	return &tableReport{lock: &l, tables: make(map[tableKey]*tableCounters)}
+}
+
+// classify returns the table and operation of a statement. A statement that cannot be parsed is counted
+// under its first word, with no table.
+func classify(text string) tableKey {
+	p, err := statement.Parse(text)
+	return classifyParsed(text, p, err)
+}
+
+// classifyParsed returns the table and operation of a statement that has already been parsed
+func classifyParsed(text string, p *statement.Parsed, err error) tableKey {
+	if err == nil {
+		return tableKey{table: p.TableName(), op: p.Op}
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return tableKey{}
+	}
+	return tableKey{op: strings.ToUpper(fields[0])}
+}
+
+// tableKey returns the table and operation of a queued statement, classifying it on first use
+func (e *batchEntry) tableKey() tableKey {
+	if e.key == nil {
+		p, err := e.parse()
+		k := classifyParsed(*e.request.Statement, p, err)
+		e.key = &k
+	}
+	return *e.key
+}
+
+// counters returns the counters of a table and operation, the lock must be held
+func (r *tableReport) counters(k tableKey) *tableCounters {
+	c, ok := r.tables[k]
+	if !ok {
+		c = &tableCounters{errors: make(map[string]int)}
+		r.tables[k] = c
+	}
+	return c
+}
+
+func (r *tableReport) executed(entries []*batchEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, e := range entries {
+		r.counters(e.tableKey()).executed++
+	}
+}
+
+func (r *tableReport) failed(k tableKey, code string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c := r.counters(k)
+	c.failed++
+	c.errors[code]++
+}
+
+// retried counts one retry of each of the passed statements
+func (r *tableReport) retried(entries []*batchEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, e := range entries {
+		r.counters(e.tableKey()).retries++
+	}
+}
+
+// call records a DynamoDB call made for the passed statements. The latency counts once for each table and
+// operation in the call, and the capacity units consumed are shared evenly between the statements.
+func (r *tableReport) call(entries []*batchEntry, elapsed time.Duration, units float64) {
+	if len(entries) == 0 {
+		return
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	share := units / float64(len(entries))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	seen := make(map[tableKey]bool, 1)
+	for _, e := range entries {
+		k := e.tableKey()
+		c := r.counters(k)
+		c.capacity += share
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		c.calls++
+		if ms > c.max {
+			c.max = ms
+		}
+		if len(c.samples) < MAX_LATENCY_SAMPLES {
+			c.samples = append(c.samples, ms)
+		} else if idx := rand.Intn(c.calls); idx < MAX_LATENCY_SAMPLES {
+			c.samples[idx] = ms
+		}
+	}
+}
+
+func (r *tableReport) stats() []TableStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats := make([]TableStats, 0, len(r.tables))
+	for k, c := range r.tables {
+		errors := make(map[string]int, len(c.errors))
+		for code, count := range c.errors {
+			errors[code] = count
+		}
+		samples := append([]float64(nil), c.samples...)
+		sort.Float64s(samples)
+		stats = append(stats, TableStats{
+			Table:         k.table,
+			Op:            k.op,
+			Executed:      c.executed,
+			Failed:        c.failed,
+			Retries:       c.retries,
+			CapacityUnits: c.capacity,
+			Errors:        errors,
+			Latency: Latency{
+				Calls: c.calls,
+				P50:   percentile(samples, 50),
+				P90:   percentile(samples, 90),
+				P99:   percentile(samples, 99),
+				Max:   c.max,
+			},
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Table != stats[j].Table {
+			return stats[i].Table < stats[j].Table
+		}
+		return stats[i].Op < stats[j].Op
+	})
+	return stats
+}
+
+// percentile returns the nearest rank percentile of sorted samples
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// ErrorClass returns the class of a DynamoDB (or pql) error code, which tells whether re-running the failed
+// statements may succeed or they must be fixed first
+func ErrorClass(code string) string {
+	if class, ok := errorClasses[strings.TrimSuffix(code, "Exception")]; ok {
+		return class
+	}
+	return ERROR_CLASS_OTHER
+}
+
+// TableStats returns the totals for each table and operation executed so far, ordered by table then
+// operation
+func (x *Executor) TableStats() []TableStats {
+	return x.tables.stats()
+}
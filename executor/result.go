@@ -0,0 +1,198 @@
+package executor
+
+import (
+	"io"
+	"pql/statement"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// The maximum number of failures kept in a Result, the dead letter file has them all
+	MAX_RESULT_FAILURES = 100
+)
+
+// Result summarizes the execution of one input
+type Result struct {
+	Name        string    `json:"name"`
+	Statements  int       `json:"statements"`            // The statements read, including skipped ones
+	Executed    int       `json:"executed"`              // The statements applied successfully
+	Failed      int       `json:"failed"`                // The statements and data rows that failed, including invalid ones
+	Skipped     int       `json:"skipped"`               // The statements skipped as completed by a previous run, per the journal
+	Moved       int       `json:"moved"`                 // The statements moved to a later batch because their item was already in the batch
+	StoppedLine int       `json:"stoppedLine,omitempty"` // The line reading stopped at when the context was done, or 0 if the input was read to the end
+	Rows        int       `json:"rows"`                  // The items returned by SELECT statements
+	Failures    []Failure `json:"failures,omitempty"`    // The first MAX_RESULT_FAILURES failures
+}
+
+// Failure is a statement or data row that could not be executed
+type Failure struct {
+	Name      string `json:"name"`
+	Line      int    `json:"line"`
+	Statement string `json:"statement"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// Stats are the running totals of an Executor across all of its inputs
+type Stats struct {
+	Executed      int     `json:"executed"`
+	Failed        int     `json:"failed"`
+	Batches       int     `json:"batches"`       // The batches and transactions executed
+	BatchesFailed int     `json:"batchesFailed"` // The batches that failed as a whole
+	Retries       int     `json:"retries"`
+	CapacityUnits int64   `json:"capacityUnits"`
+	InFlight      int     `json:"inFlight"`          // The batches and transactions being executed
+	PoolRunning   int     `json:"poolRunning"`       // The busy pool workers
+	WCURate       float64 `json:"wcuRate,omitempty"` // The enforced write capacity units per second, if WCU is set
+	RPSRate       float64 `json:"rpsRate,omitempty"` // The enforced statements per second, if RPS is set
+}
+
+// Stats returns the current totals
+func (x *Executor) Stats() Stats {
+	s := Stats{
+		Executed:      int(atomic.LoadInt32(x.executed)),
+		Failed:        int(atomic.LoadInt32(x.rowsFailed)),
+		Batches:       int(atomic.LoadInt32(x.executedBatches)),
+		BatchesFailed: int(atomic.LoadInt32(x.batchesFailed)),
+		Retries:       int(atomic.LoadInt32(x.retries)),
+		CapacityUnits: atomic.LoadInt64(x.capUsed),
+		InFlight:      int(atomic.LoadInt32(x.inFlight)),
+		PoolRunning:   x.pool.Running(),
+	}
+	if x.wcuLimiter != nil {
+		s.WCURate = x.wcuLimiter.Rate()
+	}
+	if x.rpsLimiter != nil {
+		s.RPSRate = x.rpsLimiter.Rate()
+	}
+	return s
+}
+
+// Progress is how far the execution of an input has got
+type Progress struct {
+	Name     string
+	Line     int // The last line read
+	Executed int
+	Failed   int
+}
+
+// Progress returns the progress of each input being executed, in the order they were started
+func (x *Executor) Progress() []Progress {
+	x.inputLock.Lock()
+	defer x.inputLock.Unlock()
+	p := make([]Progress, len(x.inputs))
+	for idx, in := range x.inputs {
+		p[idx] = Progress{
+			Name:     in.name,
+			Line:     int(atomic.LoadInt32(in.line)),
+			Executed: int(atomic.LoadInt32(in.executed)),
+			Failed:   int(atomic.LoadInt32(in.failed)),
+		}
+	}
+	return p
+}
+
+func (x *Executor) started(in *input) {
+	x.inputLock.Lock()
+	defer x.inputLock.Unlock()
+	x.inputs = append(x.inputs, in)
+}
+
+func (x *Executor) finished(in *input) {
+	x.inputLock.Lock()
+	defer x.inputLock.Unlock()
+	for idx, i := range x.inputs {
+		if i == in {
+			x.inputs = append(x.inputs[:idx], x.inputs[idx+1:]...)
+			break
+		}
+	}
+}
+
+// input tracks the execution of the statements read from one input. The counts updated by the reading
+// goroutine are plain ints, the counts updated from the pool are atomic.
+type input struct {
+	name        string
+	stream      bool // The input is stdin or a pipe, so its statements may arrive slowly
+	statements  int
+	skipped     int
+	moved       int
+	stoppedLine int
+	line        *int32 // The last line read, for the Progress
+	executed    *int32
+	failed      *int32
+	rows        *int32
+	output      io.WriteCloser
+	lock        *sync.Mutex
+	failures    []Failure
+}
+
+func newInput(name string) *input {
+	var l sync.Mutex
+	return &input{
+		name:     name,
+		line:     new(int32),
+		executed: new(int32),
+		failed:   new(int32),
+		rows:     new(int32),
+		lock:     &l,
+	}
+}
+
+// read notes the last line of a statement read from the input
+func (in *input) read(st statement.Statement) {
+	line := st.EndLine
+	if line < st.Line {
+		line = st.Line
+	}
+	atomic.StoreInt32(in.line, int32(line))
+}
+
+func (in *input) fail(f Failure) {
+	atomic.AddInt32(in.failed, ONE)
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if len(in.failures) < MAX_RESULT_FAILURES {
+		in.failures = append(in.failures, f)
+	}
+}
+
+func (in *input) result() *Result {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return &Result{
+		Name:        in.name,
+		Statements:  in.statements,
+		Executed:    int(atomic.LoadInt32(in.executed)),
+		Failed:      int(atomic.LoadInt32(in.failed)),
+		Skipped:     in.skipped,
+		Moved:       in.moved,
+		StoppedLine: in.stoppedLine,
+		Rows:        int(atomic.LoadInt32(in.rows)),
+		Failures:    in.failures,
+	}
+}
+
+// succeeded counts the statements of a batch as executed. Every statement of a batch is from the same input.
+func (x *Executor) succeeded(entries []*batchEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	atomic.AddInt32(x.executed, int32(len(entries)))
+	atomic.AddInt32(entries[0].in.executed, int32(len(entries)))
+	x.tables.executed(entries)
+}
+
+// fail counts a failed statement and writes it to the dead letter file
+func (x *Executor) fail(e *batchEntry, code, message string) {
+	x.failed(e, code, message)
+	x.opts.DeadLetter.Write(e, code, message)
+}
+
+// failed counts a failed statement
+func (x *Executor) failed(e *batchEntry, code, message string) {
+	atomic.AddInt32(x.rowsFailed, ONE)
+	x.tables.failed(e.tableKey(), code)
+	e.in.fail(Failure{Name: e.fileName, Line: e.line, Statement: boundStatement(e), Code: code, Message: message})
+}
@@ -0,0 +1,215 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"log"
+	"pql/ratelimit"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MAX_TRANSACTION_SIZE = 100
+	// The maximum length of an ExecuteTransaction client request token
+	MAX_TOKEN_LENGTH = 36
+)
+
+var (
+	// Scopes client request tokens to this run, so an identical transaction in a later run is not deduplicated
+	runID = time.Now().UnixNano()
+
+	// Cancellation reasons that clear up on their own, so the transaction is retried
+	retryableReasons = map[string]bool{
+		"ThrottlingError":                true,
+		"TransactionConflict":            true,
+		"ProvisionedThroughputExceeded":  true,
+		"TransactionConflictException":   true,
+		"TransactionInProgressException": true,
+	}
+)
+
+// submitTransaction executes the statements of a BEGIN TRANSACTION ... COMMIT block as a single
+// ExecuteTransaction call, retrying with the same client request token while it is throttled or conflicts
+// with another transaction. If the transaction is cancelled, the cancellation reason for each statement is
+// reported and the whole block is written to the dead letter file.
+func (x *Executor) submitTransaction(ctx context.Context, entries []*batchEntry) {
+	retryCount := 0
+	atomic.AddInt32(x.inFlight, ONE)
+	defer func() {
+		atomic.AddInt32(x.inFlight, MINUS_ONE)
+		if retryCount > 0 {
+			atomic.AddInt32(x.retries, int32(retryCount))
+		}
+	}()
+	for _, e := range entries {
+		x.substitute(e)
+	}
+	if x.opts.NoExec {
+		// Counted like a NoExec batch, as executed but not journaled
+		x.succeeded(entries)
+		atomic.AddInt32(x.executedBatches, ONE)
+		return
+	}
+	token := transactionToken(entries)
+	completed := true
+	for {
+		err := x.opts.Undo.Capture(ctx, x.client, x.schemas, entries)
+		if err == nil {
+			err = x.executeTransaction(ctx, entries, token)
+		}
+		if err == nil {
+			x.succeeded(entries)
+			x.opts.Undo.WriteTransaction(entries)
+			break
+		}
+		codes, messages, retryable := cancellationReasons(err, len(entries))
+		var tce *types.TransactionCanceledException
+		if !errors.As(err, &tce) {
+			// Failed as a whole rather than cancelled, a re-run may succeed
+			completed = false
+		}
+		if retryable {
+			retryCount++
+			x.tables.retried(entries)
+			if x.opts.MaxRetries <= 0 || retryCount <= x.opts.MaxRetries {
+				serr := ratelimit.Sleep(ctx, ratelimit.Backoff(retryCount))
+				if serr == nil {
+					continue
+				}
+				// Shutdown while backing off
+				code, message := ErrorCode(serr)
+				for idx := range codes {
+					codes[idx], messages[idx] = code, message
+				}
+			} else {
+				for idx := range messages {
+					messages[idx] = fmt.Sprintf("Retries exhausted: retries=%d, %s", x.opts.MaxRetries, messages[idx])
+				}
+			}
+			// Retries exhausted or interrupted, a re-run may succeed
+			completed = false
+		}
+		for idx, e := range entries {
+			if codes[idx] != "None" {
+				log.Printf("Transaction Cancelled: file=%s, line=%d, code=%s, error=%s\n", e.fileName, e.line, codes[idx], messages[idx])
+			}
+		}
+		x.failAll(entries, codes, messages)
+		break
+	}
+	atomic.AddInt32(x.executedBatches, ONE)
+	if completed {
+		x.opts.Journal.Record(entries)
+	}
+}
+
+func (x *Executor) executeTransaction(ctx context.Context, entries []*batchEntry, token string) error {
+	statements := make([]types.ParameterizedStatement, len(entries))
+	for idx, e := range entries {
+		statements[idx] = types.ParameterizedStatement{
+			Statement:  e.request.Statement,
+			Parameters: e.request.Parameters,
+		}
+	}
+	// Transactional writes consume two write capacity units per item
+	estimate := float64(len(statements))
+	if err := x.rpsLimiter.Wait(ctx, estimate); err != nil {
+		return err
+	}
+	if err := x.wcuLimiter.Wait(ctx, 2*estimate); err != nil {
+		return err
+	}
+	startTime := time.Now()
+	out, err := x.client.ExecuteTransaction(context.TODO(), &dynamodb.ExecuteTransactionInput{
+		TransactStatements:     statements,
+		ClientRequestToken:     aws.String(token),
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+	})
+	x.opts.TransactionLatency.ObserveSince(startTime)
+	if err != nil {
+		x.tables.call(entries, time.Since(startTime), 0)
+		if _, _, retryable := cancellationReasons(err, len(entries)); retryable {
+			x.rpsLimiter.Throttled()
+			x.wcuLimiter.Throttled()
+		}
+		return err
+	}
+	totalUnits := float64(0)
+	for _, cc := range out.ConsumedCapacity {
+		if cc.CapacityUnits != nil {
+			totalUnits += *cc.CapacityUnits
+		}
+	}
+	atomic.AddInt64(x.capUsed, int64(totalUnits))
+	x.tables.call(entries, time.Since(startTime), totalUnits)
+	x.wcuLimiter.Adjust(totalUnits - 2*estimate)
+	x.rpsLimiter.Succeeded()
+	x.wcuLimiter.Succeeded()
+	return nil
+}
+
+// cancellationReasons returns the error code and message for each statement of a failed transaction,
+// and whether the transaction should be retried
+func cancellationReasons(err error, size int) ([]string, []string, bool) {
+	codes := make([]string, size)
+	messages := make([]string, size)
+	var tce *types.TransactionCanceledException
+	if errors.As(err, &tce) && len(tce.CancellationReasons) == size {
+		retryable := false
+		for idx, reason := range tce.CancellationReasons {
+			codes[idx] = aws.ToString(reason.Code)
+			messages[idx] = aws.ToString(reason.Message)
+			if retryableReasons[codes[idx]] {
+				retryable = true
+			}
+		}
+		return codes, messages, retryable
+	}
+	code, message := ErrorCode(err)
+	for idx := range codes {
+		codes[idx] = code
+		messages[idx] = message
+	}
+	return codes, messages, isThrottle(err) || retryableReasons[code]
+}
+
+// failTransaction fails a transaction block without executing it
+func (x *Executor) failTransaction(entries []*batchEntry, code, message string) {
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("ERROR: Transaction not executed: file=%s, line=%d, error=%s\n", entries[0].fileName, entries[0].line, message)
+	codes := make([]string, len(entries))
+	messages := make([]string, len(entries))
+	for idx := range entries {
+		codes[idx] = code
+		messages[idx] = message
+	}
+	x.failAll(entries, codes, messages)
+}
+
+// failAll counts the failed statements of a transaction and writes them to the dead letter file together
+func (x *Executor) failAll(entries []*batchEntry, codes, messages []string) {
+	for idx, e := range entries {
+		x.failed(e, codes[idx], messages[idx])
+	}
+	x.opts.DeadLetter.WriteTransaction(entries, codes, messages)
+}
+
+// transactionToken builds an idempotency token from the transaction's statements, so a retry of a
+// transaction that did complete is not applied twice
+func transactionToken(entries []*batchEntry) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", runID)
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s:%d:%s\n", e.fileName, e.line, aws.ToString(e.request.Statement))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:MAX_TOKEN_LENGTH]
+}
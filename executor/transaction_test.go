@@ -0,0 +1,38 @@
+package executor
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNoExecTransactionCountedLikeBatches(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 2, NoExec: true})
+	res, err := x.ExecuteStatements(context.Background(), "noexec",
+		`UPDATE "t" SET v = 1 WHERE pk = 'a'`,
+		"BEGIN TRANSACTION",
+		`UPDATE "t" SET v = 2 WHERE pk = 'b'`,
+		`DELETE FROM "t" WHERE pk = 'c'`,
+		"COMMIT",
+	)
+	if err != nil {
+		t.Fatalf("ExecuteStatements() = %v", err)
+	}
+	if res.Executed != 3 || res.Failed != 0 {
+		t.Errorf("result executed=%d, failed=%d, want 3 and 0", res.Executed, res.Failed)
+	}
+	st := x.Stats()
+	if st.Executed != 3 || st.Batches != 2 || st.InFlight != 0 {
+		t.Errorf("stats executed=%d, batches=%d, inflight=%d, want 3, 2 and 0", st.Executed, st.Batches, st.InFlight)
+	}
+	if n := db.callCount("ExecuteTransaction") + db.callCount("BatchExecuteStatement"); n != 0 {
+		t.Errorf("%d statements sent with NoExec", n)
+	}
+	tableExecuted := 0
+	for _, ts := range x.TableStats() {
+		tableExecuted += ts.Executed
+	}
+	if tableExecuted != 3 {
+		t.Errorf("table stats executed=%d, want 3", tableExecuted)
+	}
+}
@@ -0,0 +1,336 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"pql/ddb"
+	"pql/ratelimit"
+	"pql/statement"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	MAX_GET_BATCH_SIZE = 100
+)
+
+// Undo writes a compensating statement for each statement that is applied, built from the item as it was
+// fetched just before the statement ran, so the file can be passed back to pql to roll a run back:
+// an UPDATE restoring the changed attributes, an INSERT re-creating a deleted item, or a DELETE removing
+// an inserted one. The file is compressed when it is named with a .gz or .zst extension.
+//
+// The statements are spilled to a temporary file as they are applied and written to the undo file in
+// reverse order on Close, so the last change to an item is undone first. pql executes a file in parallel
+// batches, so a "break" directive is written before a statement for an item already undone since the last
+// break, and the statements for an item that was changed several times are executed one after another.
+type Undo struct {
+	fileName string
+	spill    *os.File
+	writer   *bufio.Writer
+	offset   int64
+	records  []undoRecord
+	lock     *sync.Mutex
+	count    int
+}
+
+// undoRecord is the location of a compensating statement, or transaction, in the spill file
+type undoRecord struct {
+	offset int64
+	size   int
+	items  []uint64
+}
+
+func NewUndo(fileName string) (*Undo, error) {
+	// Created up front so an unwritable undo file fails the run before anything is applied
+	if o, err := CreateOutput(fileName); err != nil {
+		return nil, err
+	} else if err = o.Close(); err != nil {
+		return nil, err
+	}
+	spill, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	var l sync.Mutex
+	return &Undo{
+		fileName: fileName,
+		spill:    spill,
+		writer:   bufio.NewWriterSize(spill, 64*1024),
+		records:  make([]undoRecord, 0, 1024),
+		lock:     &l,
+	}, nil
+}
+
+// Capture builds the compensating statement of each entry that does not have one yet, fetching the current
+// items of UPDATE and DELETE statements by primary key, until the context is done. A nil Undo does nothing.
+func (u *Undo) Capture(ctx context.Context, client *dynamodb.Client, schemas *ddb.Schemas, entries []*batchEntry) error {
+	if u == nil {
+		return nil
+	}
+	pending := make([]*undoCapture, 0, len(entries))
+	for _, e := range entries {
+		if e.captured {
+			continue
+		}
+		e.captured = true
+		p, k, err := entryKey(schemas, e)
+		if err != nil {
+			// The statement will fail on its own, or cannot be undone
+			if p != nil && p.Op != statement.OP_SELECT && p.Op != statement.OP_EXISTS {
+				log.Printf("WARNING: Cannot generate undo statement: file=%s, line=%d, error=%s\n", e.fileName, e.line, err.Error())
+			}
+			continue
+		}
+		e.undoItem = itemHash(k)
+		if p.Op == statement.OP_INSERT {
+			e.undo = fmt.Sprintf("DELETE FROM %s %s", quoteName(k.schema.Table), k.where())
+			continue
+		}
+		pending = append(pending, &undoCapture{entry: e, parsed: p, key: k})
+	}
+	for len(pending) > 0 {
+		size := len(pending)
+		if size > MAX_GET_BATCH_SIZE {
+			size = MAX_GET_BATCH_SIZE
+		}
+		if err := fetchItems(ctx, client, pending[:size]); err != nil {
+			for _, c := range pending {
+				c.entry.captured = false
+			}
+			return err
+		}
+		for _, c := range pending[:size] {
+			c.entry.undo = c.statement()
+		}
+		pending = pending[size:]
+	}
+	return nil
+}
+
+// Write records the compensating statement of an applied entry. A nil Undo discards it.
+func (u *Undo) Write(e *batchEntry) {
+	if u == nil || e.undo == "" {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	var b strings.Builder
+	writeUndo(&b, e)
+	u.spillRecord(b.String(), []uint64{e.undoItem})
+	u.count++
+}
+
+// WriteTransaction records the compensating statements of an applied transaction as a transaction,
+// in reverse order. A nil Undo discards them.
+func (u *Undo) WriteTransaction(entries []*batchEntry) {
+	if u == nil {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	var b strings.Builder
+	items := make([]uint64, 0, len(entries))
+	b.WriteString("BEGIN TRANSACTION;\n")
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		if entries[idx].undo != "" {
+			writeUndo(&b, entries[idx])
+			items = append(items, entries[idx].undoItem)
+			u.count++
+		}
+	}
+	b.WriteString("COMMIT;\n")
+	u.spillRecord(b.String(), items)
+}
+
+func writeUndo(b *strings.Builder, e *batchEntry) {
+	fmt.Fprintf(b, "-- file=%s, line=%d\n", e.fileName, e.line)
+	fmt.Fprintf(b, "%s;\n", e.undo)
+}
+
+func (u *Undo) spillRecord(text string, items []uint64) {
+	if _, err := u.writer.WriteString(text); err != nil {
+		log.Printf("WARNING: Failed to write undo statement: file=%s, error=%s\n", u.spill.Name(), err.Error())
+		return
+	}
+	u.records = append(u.records, undoRecord{offset: u.offset, size: len(text), items: items})
+	u.offset += int64(len(text))
+}
+
+// Close writes the undo file from the spilled statements, last applied first, and removes the spill file
+func (u *Undo) Close() {
+	if u == nil {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.spill == nil {
+		return
+	}
+	defer func() {
+		u.spill.Close()
+		os.Remove(u.spill.Name())
+		u.spill = nil
+	}()
+	if err := u.writer.Flush(); err != nil {
+		log.Printf("WARNING: Failed to write undo statements: file=%s, error=%s\n", u.spill.Name(), err.Error())
+	}
+	o, err := CreateOutput(u.fileName)
+	if err != nil {
+		log.Printf("WARNING: Failed to create undo file: file=%s, error=%s\n", u.fileName, err.Error())
+		return
+	}
+	seen := make(map[uint64]bool, 1024)
+	buf := make([]byte, 0, 4096)
+	for idx := len(u.records) - 1; idx >= 0; idx-- {
+		r := u.records[idx]
+		for _, item := range r.items {
+			if seen[item] {
+				fmt.Fprintf(o, "break\n")
+				seen = make(map[uint64]bool, 1024)
+				break
+			}
+		}
+		for _, item := range r.items {
+			seen[item] = true
+		}
+		if cap(buf) < r.size {
+			buf = make([]byte, r.size)
+		}
+		buf = buf[:r.size]
+		if _, err = u.spill.ReadAt(buf, r.offset); err != nil {
+			break
+		}
+		if _, err = o.Write(buf); err != nil {
+			break
+		}
+	}
+	if cerr := o.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to write undo file: file=%s, error=%s\n", u.fileName, err.Error())
+	}
+	log.Printf("Undo Statements: file=%s, statements=%d\n", u.fileName, u.count)
+}
+
+// itemHash identifies the item of a key, for finding the undo statements that restore the same item
+func itemHash(k *itemKey) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(k.String()))
+	return h.Sum64()
+}
+
+// undoCapture is an UPDATE or DELETE waiting for its item to be fetched
+type undoCapture struct {
+	entry  *batchEntry
+	parsed *statement.Parsed
+	key    *itemKey
+	item   map[string]types.AttributeValue
+}
+
+// statement returns the compensating statement for the fetched item
+func (c *undoCapture) statement() string {
+	table := quoteName(c.key.schema.Table)
+	if c.item == nil {
+		if c.parsed.Op == statement.OP_DELETE {
+			return ""
+		}
+		// The UPDATE created the item
+		return fmt.Sprintf("DELETE FROM %s %s", table, c.key.where())
+	}
+	if c.parsed.Op == statement.OP_DELETE {
+		return fmt.Sprintf("INSERT INTO %s VALUE %s", table, ddb.AVToPartiQL(&types.AttributeValueMemberM{Value: c.item}))
+	}
+	// Restore the top level attributes the UPDATE sets or removes
+	roots := make(map[string]bool)
+	for _, a := range c.parsed.Set {
+		roots[rootName(a.Name)] = true
+	}
+	for _, path := range c.parsed.Remove {
+		roots[rootName(path)] = true
+	}
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clauses := make([]string, 0, len(names))
+	for _, name := range names {
+		if old, ok := c.item[name]; ok {
+			clauses = append(clauses, fmt.Sprintf("SET %s = %s", quoteName(name), ddb.AVToPartiQL(old)))
+		} else {
+			clauses = append(clauses, fmt.Sprintf("REMOVE %s", quoteName(name)))
+		}
+	}
+	return fmt.Sprintf("UPDATE %s %s %s", table, strings.Join(clauses, " "), c.key.where())
+}
+
+// rootName returns the top level attribute of a document path, e.g. a for a.b[0]
+func rootName(path string) string {
+	path = strings.TrimSpace(path)
+	if strings.HasPrefix(path, "\"") {
+		if end := strings.Index(path[1:], "\""); end != -1 {
+			return path[1 : end+1]
+		}
+	}
+	if idx := strings.IndexAny(path, ".["); idx != -1 {
+		return strings.TrimSpace(path[:idx])
+	}
+	return path
+}
+
+// fetchItems reads the current items of the passed captures with a consistent BatchGetItem,
+// retrying unprocessed keys
+func fetchItems(ctx context.Context, client *dynamodb.Client, captures []*undoCapture) error {
+	byKey := make(map[string][]*undoCapture, len(captures))
+	request := make(map[string]types.KeysAndAttributes)
+	for _, c := range captures {
+		id := c.key.String()
+		if _, seen := byKey[id]; !seen {
+			ka := request[c.key.schema.Table]
+			ka.Keys = append(ka.Keys, c.key.key)
+			ka.ConsistentRead = aws.Bool(true)
+			request[c.key.schema.Table] = ka
+		}
+		byKey[id] = append(byKey[id], c)
+	}
+	attempt := 0
+	for len(request) > 0 {
+		out, err := client.BatchGetItem(context.TODO(), &dynamodb.BatchGetItemInput{RequestItems: request})
+		if err != nil {
+			return err
+		}
+		for table, items := range out.Responses {
+			for _, item := range items {
+				k := &itemKey{schema: captures[0].key.schema, key: item}
+				for _, c := range captures {
+					if c.key.schema.Table == table {
+						k.schema = c.key.schema
+						break
+					}
+				}
+				for _, c := range byKey[k.String()] {
+					c.item = item
+				}
+			}
+		}
+		request = out.UnprocessedKeys
+		if len(request) > 0 {
+			attempt++
+			if err := ratelimit.Sleep(ctx, ratelimit.Backoff(attempt)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
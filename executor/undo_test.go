@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// undoStatements returns the statements and directives of an undo file, without its comments
+func undoStatements(t *testing.T, fileName string) []string {
+	t.Helper()
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0, 8)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if !strings.HasPrefix(line, "--") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestUndoSpillWrittenInReverse(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "run.undo")
+	u, err := NewUndo(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The statements are held in the spill file next to the undo file until Close
+	if spills, _ := filepath.Glob(fileName + ".*.tmp"); len(spills) != 1 {
+		t.Fatalf("spill files = %v, want one", spills)
+	}
+	u.Write(&batchEntry{fileName: "in.pql", line: 1, undo: "UNDO a1", undoItem: 1})
+	u.Write(&batchEntry{fileName: "in.pql", line: 2, undo: "UNDO b1", undoItem: 2})
+	// Nothing to undo, e.g. a DELETE of an item that did not exist
+	u.Write(&batchEntry{fileName: "in.pql", line: 3, undoItem: 3})
+	u.WriteTransaction([]*batchEntry{
+		{fileName: "in.pql", line: 5, undo: "UNDO c1", undoItem: 3},
+		{fileName: "in.pql", line: 6, undo: "UNDO a2", undoItem: 1},
+	})
+	u.Write(&batchEntry{fileName: "in.pql", line: 8, undo: "UNDO b2", undoItem: 2})
+	u.Close()
+	u.Close()
+
+	want := []string{
+		"UNDO b2;",
+		"BEGIN TRANSACTION;", "UNDO a2;", "UNDO c1;", "COMMIT;",
+		// b and a were undone since the last break, so their earlier changes wait for the ones above
+		"break",
+		"UNDO b1;",
+		"UNDO a1;",
+	}
+	if got := undoStatements(t, fileName); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("undo file =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if spills, _ := filepath.Glob(fileName + ".*.tmp"); len(spills) != 0 {
+		t.Errorf("spill files left after Close: %v", spills)
+	}
+}
+
+func TestUndoSpillCompressed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "run.undo.gz")
+	u, err := NewUndo(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := "UPDATE \"t\" SET v = '" + strings.Repeat("x", 100*1024) + "' WHERE pk = 'a'"
+	u.Write(&batchEntry{fileName: "in.pql", line: 1, undo: big, undoItem: 1})
+	u.Write(&batchEntry{fileName: "in.pql", line: 2, undo: "DELETE FROM \"t\" WHERE pk = 'b'", undoItem: 2})
+	u.Close()
+
+	// Read back the way pql reads its input, so the undo file can be passed straight back to it
+	db := newFakeDynamoDB(t)
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 2})
+	res, err := x.ExecuteFile(context.Background(), fileName)
+	if err != nil {
+		t.Fatalf("ExecuteFile() = %v", err)
+	}
+	if res.Executed != 2 || db.appliedIndex(strings.Repeat("x", 100*1024)) == -1 {
+		t.Errorf("executed=%d of the undo file, want both statements intact", res.Executed)
+	}
+}
+
+func TestUndoCapturesFetchedItems(t *testing.T) {
+	db := newFakeDynamoDB(t)
+	db.items["a"] = map[string]interface{}{"pk": map[string]string{"S": "a"}, "v": map[string]string{"S": "old"}}
+	db.items["b"] = map[string]interface{}{"pk": map[string]string{"S": "b"}, "v": map[string]string{"N": "1"}}
+	fileName := filepath.Join(t.TempDir(), "run.undo")
+	u, err := NewUndo(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := newTestExecutor(t, Options{Client: db.client(), Concurrency: 1, Undo: u})
+	_, err = x.ExecuteStatements(context.Background(), "capture",
+		`UPDATE "t" SET v = 'new' SET w = 1 WHERE pk = 'a'`,
+		`DELETE FROM "t" WHERE pk = 'b'`,
+		`DELETE FROM "t" WHERE pk = 'missing'`,
+		`INSERT INTO "t" VALUE {'pk' : 'c'}`,
+	)
+	if err != nil {
+		t.Fatalf("ExecuteStatements() = %v", err)
+	}
+	u.Close()
+	got := strings.Join(undoStatements(t, fileName), "\n")
+	for _, want := range []string{
+		`UPDATE "t" SET "v" = 'old' REMOVE "w" WHERE "pk" = 'a';`,
+		`INSERT INTO "t" VALUE {'pk' : 'b', 'v' : 1};`,
+		`DELETE FROM "t" WHERE "pk" = 'c';`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("undo file missing %s in\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "missing") {
+		t.Errorf("undo file restores an item that did not exist:\n%s", got)
+	}
+}
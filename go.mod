@@ -1,16 +1,31 @@
 module pql
 
-go 1.16
+go 1.17
 
 require (
-	github.com/andrew-d/go-termutil v0.0.0-20150726205930-009166a695a2 // indirect
-	github.com/aws/aws-sdk-go-v2 v1.13.0 // indirect
-	github.com/aws/aws-sdk-go-v2/config v1.13.0 // indirect
-	github.com/aws/aws-sdk-go-v2/credentials v1.8.0 // indirect
-	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.13.0 // indirect
-	github.com/aws/smithy-go v1.10.0 // indirect
-	github.com/bcicen/jstream v1.0.1 // indirect
+	github.com/andrew-d/go-termutil v0.0.0-20150726205930-009166a695a2
+	github.com/aws/aws-sdk-go-v2 v1.13.0
+	github.com/aws/aws-sdk-go-v2/config v1.13.0
+	github.com/aws/aws-sdk-go-v2/credentials v1.8.0
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.13.0
+	github.com/aws/smithy-go v1.10.0
+	github.com/bcicen/jstream v1.0.1
+	github.com/jaswdr/faker v1.10.2
+	github.com/klauspost/compress v1.15.9
+	github.com/panjf2000/ants/v2 v2.4.7
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.10.0 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.1.4 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.2.0 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/ini v1.3.4 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.7.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/endpoint-discovery v1.5.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.7.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sso v1.9.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sts v1.14.0 // indirect
 	github.com/bxcodec/faker/v3 v3.7.0 // indirect
-	github.com/jaswdr/faker v1.10.2 // indirect
-	github.com/panjf2000/ants/v2 v2.4.7 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
 )
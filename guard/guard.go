@@ -0,0 +1,333 @@
+package guard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"pql/audit"
+	"pql/config"
+	"pql/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Comma separated patterns (e.g. *prod*) of the profiles, regions and tables that are protected
+	PROTECTED_PROFILES_ENV = "PQL_PROTECTED_PROFILES"
+	PROTECTED_REGIONS_ENV  = "PQL_PROTECTED_REGIONS"
+	PROTECTED_TABLES_ENV   = "PQL_PROTECTED_TABLES"
+
+	// The profiles protected when PQL_PROTECTED_PROFILES is not set
+	DEFAULT_PROTECTED_PROFILES = "*prod*"
+
+	// The environment credentials used by a target without a profile, and the shared files they are
+	// looked up in to find the profiles they belong to
+	AWS_PROFILE_ENV          = "AWS_PROFILE"
+	AWS_KEY_ENV              = "AWS_ACCESS_KEY_ID"
+	AWS_CREDENTIALS_FILE_ENV = "AWS_SHARED_CREDENTIALS_FILE"
+	AWS_CONFIG_FILE_ENV      = "AWS_CONFIG_FILE"
+
+	// The flag that confirms destructive operations on protected targets without a prompt
+	OVERRIDE_FLAG  = "i-know-what-i-am-doing"
+	OVERRIDE_USAGE = "Specify to confirm destructive operations against protected profiles, regions and tables without being prompted (the decision is still audited)"
+
+	// The terminal prompted for confirmation, which works even while stdin is the input
+	TTY_NAME = "/dev/tty"
+
+	// The destructive operations guarded, along with the pql DELETE and UPDATE statements
+	OP_TRUNCATE = "TRUNCATE"
+
+	DECISION_CONFIRMED = "confirmed"
+	DECISION_OVERRIDE  = "override"
+	DECISION_DENIED    = "denied"
+)
+
+// Guard protects production profiles, regions and tables from destructive operations: truncation, and pql
+// DELETE and UPDATE statements. They must be confirmed by typing the table name, or by the override flag.
+// Patterns are matched case insensitively, with path.Match syntax.
+type Guard struct {
+	Tool     string
+	Profiles []string
+	Regions  []string
+	Tables   []string
+	All      bool // Every target is protected, as configured for the environment
+	Override bool
+}
+
+// Target is the account and region operations are executed against
+type Target struct {
+	Name    string
+	Profile string
+	Region  string
+}
+
+// Operation is a destructive operation on a table. An empty Table means the tables are not known, such
+// as for statements read from stdin.
+type Operation struct {
+	Op         string `json:"op"`
+	Table      string `json:"table"`
+	Statements int    `json:"statements,omitempty"`
+}
+
+// Decision is the audit record of a confirmation
+type Decision struct {
+	Type       string      `json:"type"`
+	Time       time.Time   `json:"time"`
+	Tool       string      `json:"tool"`
+	User       string      `json:"user"`
+	Host       string      `json:"host"`
+	Target     string      `json:"target,omitempty"`
+	Profile    string      `json:"profile,omitempty"`
+	Region     string      `json:"region"`
+	Operations []Operation `json:"operations"`
+	Decision   string      `json:"decision"`
+	Reason     string      `json:"reason,omitempty"`
+}
+
+// FromEnv creates the guard configured by the PQL_PROTECTED_* environment variables, along with the
+// protection of the environment applied from the config file
+func FromEnv(tool string, override bool) *Guard {
+	g := &Guard{
+		Tool:     tool,
+		Profiles: splitPatterns(util.Env(DEFAULT_PROTECTED_PROFILES, PROTECTED_PROFILES_ENV)),
+		Regions:  splitPatterns(util.Env("", PROTECTED_REGIONS_ENV)),
+		Tables:   splitPatterns(util.Env("", PROTECTED_TABLES_ENV)),
+		Override: override,
+	}
+	if e := config.Current(); e != nil {
+		g.All = e.Protected
+		g.Tables = append(g.Tables, e.ProtectedTables...)
+	}
+	return g
+}
+
+// IsProtected returns true if the profile or region of a target is protected. A target without a profile
+// uses the environment's credentials, so it is protected if AWS_PROFILE, or any shared profile with the
+// same access key ID as AWS_ACCESS_KEY_ID, is.
+func (g *Guard) IsProtected(t Target) bool {
+	if g.All || matches(g.Regions, t.Region) {
+		return true
+	}
+	for _, profile := range targetProfiles(t) {
+		if matches(g.Profiles, profile) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetProfiles returns the profile of a target, or the profiles the environment's credentials resolve to
+func targetProfiles(t Target) []string {
+	if t.Profile != "" {
+		return []string{t.Profile}
+	}
+	profiles := make([]string, 0, 2)
+	if profile := os.Getenv(AWS_PROFILE_ENV); profile != "" {
+		profiles = append(profiles, profile)
+	}
+	if key := os.Getenv(AWS_KEY_ENV); key != "" {
+		profiles = append(profiles, profilesWithKey(sharedFile(AWS_CREDENTIALS_FILE_ENV, "credentials"), key)...)
+		profiles = append(profiles, profilesWithKey(sharedFile(AWS_CONFIG_FILE_ENV, "config"), key)...)
+	}
+	return profiles
+}
+
+// sharedFile returns the shared credentials or config file named by the environment variable, or the
+// default one in ~/.aws
+func sharedFile(env, name string) string {
+	if fileName := os.Getenv(env); fileName != "" {
+		return fileName
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".aws", name)
+}
+
+// profilesWithKey returns the profiles of a shared credentials or config file with the access key ID
+func profilesWithKey(fileName, key string) []string {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	profiles := make([]string, 0, 1)
+	profile := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			// Config file sections are named "profile <name>", except the default
+			profile = strings.TrimSpace(strings.TrimPrefix(strings.Trim(line, "[]"), "profile "))
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "aws_access_key_id" && strings.TrimSpace(parts[1]) == key {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles
+}
+
+// HasProtectedTables returns true if any tables are protected whatever the target
+func (g *Guard) HasProtectedTables() bool {
+	return len(g.Tables) > 0
+}
+
+// IsTableProtected returns true if a table is protected whatever the target
+func (g *Guard) IsTableProtected(table string) bool {
+	return matches(g.Tables, table)
+}
+
+// TableNames returns the protected tables when every pattern names a single table, or nil if any pattern
+// has a wildcard
+func (g *Guard) TableNames() []string {
+	for _, p := range g.Tables {
+		if strings.ContainsAny(p, "*?[\\") {
+			return nil
+		}
+	}
+	return g.Tables
+}
+
+// Protected returns the operations that need confirming on a target: every operation on a protected
+// target, and the operations on protected tables elsewhere. Operations on unknown tables may be on a
+// protected table, so they always need confirming if any tables are protected.
+func (g *Guard) Protected(t Target, ops []Operation) []Operation {
+	protected := make([]Operation, 0, len(ops))
+	targetProtected := g.IsProtected(t)
+	for _, op := range ops {
+		if targetProtected || op.Table == "" && g.HasProtectedTables() || op.Table != "" && matches(g.Tables, op.Table) {
+			protected = append(protected, op)
+		}
+	}
+	return protected
+}
+
+// Confirm asks for the destructive operations on a protected target to be confirmed by typing each table
+// name (or the target name, for operations on unknown tables) on the terminal. The override flag confirms
+// them without a prompt. The decision is appended to the audit file, and an error is returned unless the
+// operations were confirmed.
+func (g *Guard) Confirm(t Target, ops []Operation) error {
+	protected := g.Protected(t, ops)
+	if len(protected) == 0 {
+		return nil
+	}
+	d := Decision{
+		Type:       "guard",
+		Time:       time.Now(),
+		Tool:       g.Tool,
+		User:       audit.User(),
+		Host:       audit.Host(),
+		Target:     t.Name,
+		Profile:    t.Profile,
+		Region:     t.Region,
+		Operations: protected,
+	}
+	var err error
+	if g.Override {
+		d.Decision = DECISION_OVERRIDE
+		log.Printf("WARNING: Destructive operations on protected target confirmed by -%s: target=%s, operations=%s\n", OVERRIDE_FLAG, t.Name, describe(protected))
+	} else if tty, terr := os.OpenFile(TTY_NAME, os.O_RDWR, 0); terr != nil {
+		d.Decision = DECISION_DENIED
+		d.Reason = "No terminal to confirm on: " + terr.Error()
+		err = fmt.Errorf("Destructive operations on protected target %s need confirming on a terminal, or with -%s: %s", t.Name, OVERRIDE_FLAG, describe(protected))
+	} else {
+		err = prompt(tty, tty, t, protected)
+		tty.Close()
+		if err != nil {
+			d.Decision = DECISION_DENIED
+			d.Reason = err.Error()
+		} else {
+			d.Decision = DECISION_CONFIRMED
+		}
+	}
+	if aerr := audit.Append(d); aerr != nil {
+		log.Printf("WARNING: Failed to write audit record: file=%s, error=%s\n", audit.FileName(), aerr.Error())
+	}
+	return err
+}
+
+// prompt lists the protected operations and reads back each confirmation name
+func prompt(in io.Reader, out io.Writer, t Target, ops []Operation) error {
+	fmt.Fprintf(out, "\nWARNING: Destructive operations on a PROTECTED target: target=%s, profile=%s, region=%s\n", t.Name, t.Profile, t.Region)
+	for _, op := range ops {
+		if op.Table == "" {
+			fmt.Fprintf(out, "  %s on unknown tables\n", op.Op)
+		} else if op.Statements > 0 {
+			fmt.Fprintf(out, "  %s %s (%d statements)\n", op.Op, op.Table, op.Statements)
+		} else {
+			fmt.Fprintf(out, "  %s %s\n", op.Op, op.Table)
+		}
+	}
+	reader := bufio.NewReader(in)
+	for _, name := range confirmationNames(t, ops) {
+		fmt.Fprintf(out, "Type %s to confirm: ", name)
+		line, err := reader.ReadString('\n')
+		if strings.TrimSpace(line) != name {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			return errors.New("Confirmation did not match " + name)
+		}
+	}
+	return nil
+}
+
+// confirmationNames returns the names to type: each protected table, and the target name if any tables
+// are unknown
+func confirmationNames(t Target, ops []Operation) []string {
+	seen := make(map[string]bool, len(ops))
+	names := make([]string, 0, len(ops))
+	for _, op := range ops {
+		name := op.Table
+		if name == "" {
+			name = t.Name
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func describe(ops []Operation) string {
+	parts := make([]string, len(ops))
+	for idx, op := range ops {
+		table := op.Table
+		if table == "" {
+			table = "*"
+		}
+		parts[idx] = op.Op + " " + table
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches returns true if the name matches any of the patterns, case insensitively
+func matches(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		if ok, err := path.Match(strings.ToLower(p), name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPatterns(s string) []string {
+	patterns := make([]string, 0, 4)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,75 @@
+package guard
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvironmentCredentialsProtected(t *testing.T) {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "credentials")
+	config := filepath.Join(dir, "config")
+	os.WriteFile(credentials, []byte("[qa]\naws_access_key_id = AKIAQA\n\n[acme-prod]\naws_access_key_id=AKIAPROD\n"), 0600)
+	os.WriteFile(config, []byte("[default]\nregion = us-east-1\n\n[profile prod-admin]\naws_access_key_id = AKIAADMIN\n"), 0600)
+	t.Setenv(AWS_CREDENTIALS_FILE_ENV, credentials)
+	t.Setenv(AWS_CONFIG_FILE_ENV, config)
+	g := &Guard{Profiles: []string{"*prod*"}}
+
+	tests := []struct {
+		name    string
+		profile string // AWS_PROFILE
+		key     string // AWS_ACCESS_KEY_ID
+		target  Target
+		want    bool
+	}{
+		{name: "key of a protected credentials profile", key: "AKIAPROD", want: true},
+		{name: "key of a protected config profile", key: "AKIAADMIN", want: true},
+		{name: "key of an unprotected profile", key: "AKIAQA", want: false},
+		{name: "key in no profile", key: "AKIAOTHER", want: false},
+		{name: "protected AWS_PROFILE", profile: "Prod", key: "AKIAQA", want: true},
+		{name: "explicit profile wins over the environment", key: "AKIAPROD", target: Target{Profile: "qa"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(AWS_PROFILE_ENV, tt.profile)
+			t.Setenv(AWS_KEY_ENV, tt.key)
+			if got := g.IsProtected(tt.target); got != tt.want {
+				t.Errorf("IsProtected(%+v) = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromEnvDefaults(t *testing.T) {
+	t.Setenv(AWS_PROFILE_ENV, "")
+	t.Setenv(AWS_KEY_ENV, "")
+	tests := []struct {
+		name     string
+		profiles string // PQL_PROTECTED_PROFILES
+		regions  string // PQL_PROTECTED_REGIONS
+		target   Target
+		want     bool
+	}{
+		{name: "production profile protected by default", target: Target{Profile: "Acme-PROD"}, want: true},
+		{name: "other profile unprotected by default", target: Target{Profile: "qa", Region: "us-east-1"}, want: false},
+		{name: "no profile unprotected by default", target: Target{}, want: false},
+		{name: "setting the profiles replaces the default", profiles: "qa", target: Target{Profile: "prod"}, want: false},
+		{name: "blank patterns are ignored", profiles: " , qa ,", target: Target{Profile: "QA"}, want: true},
+		{name: "protected region", regions: "eu-*", target: Target{Profile: "qa", Region: "eu-west-1"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(PROTECTED_PROFILES_ENV, tt.profiles)
+			t.Setenv(PROTECTED_REGIONS_ENV, tt.regions)
+			t.Setenv(PROTECTED_TABLES_ENV, "")
+			g := FromEnv("test", false)
+			if got := g.IsProtected(tt.target); got != tt.want {
+				t.Errorf("IsProtected(%+v) = %v, want %v", tt.target, got, tt.want)
+			}
+			if g.HasProtectedTables() {
+				t.Errorf("Tables = %v, want none by default", g.Tables)
+			}
+		})
+	}
+}
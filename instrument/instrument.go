@@ -7,7 +7,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"log"
 	"math/rand"
+	"pql/config"
 	"pql/ddb"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,9 +26,9 @@ const (
 )
 
 var (
-	tableName      = aws.String("ref.instruments")
-	projectionsArr = []string{COL_INSTR_ID, COL_SYMBOL, COL_INSTR_TYPE_ID, COL_TPLUS, COL_T_STATUS}
-	projections    = aws.String(strings.Join(projectionsArr, ","))
+	instrumentsTable = "ref.instruments"
+	projectionsArr   = []string{COL_INSTR_ID, COL_SYMBOL, COL_INSTR_TYPE_ID, COL_TPLUS, COL_T_STATUS}
+	projections      = aws.String(strings.Join(projectionsArr, ","))
 )
 
 type Instrument struct {
@@ -79,7 +81,7 @@ func (i *InstrumentLoader) Load() *InstrumentLoader {
 	wg.Add(routines)
 	for idx := 0; idx < routines; idx++ {
 		scans[idx] = &dynamodb.ScanInput{
-			TableName:            tableName,
+			TableName:            aws.String(config.TableName(instrumentsTable)),
 			ProjectionExpression: projections,
 			Segment:              aws.Int32(int32(idx)),
 			TotalSegments:        totalRoutines,
@@ -94,6 +96,7 @@ func (i *InstrumentLoader) Load() *InstrumentLoader {
 		go i.loadSegment(scans[idx], &wg)
 	}
 	wg.Wait()
+	i.renumber()
 	i.loaded = int32(len(i.instrumentsBySeq))
 	log.Printf("Instruments Loaded: count=%d, elapsed=%s\n", len(i.instrumentsBySymbol), time.Since(startTime).String())
 	return i
@@ -126,12 +129,11 @@ func (i *InstrumentLoader) loadSegment(scanInput *dynamodb.ScanInput, wg *sync.W
 					}
 					i.index(instr)
 				}
-				if out.LastEvaluatedKey == nil || len(out.LastEvaluatedKey) == 0 {
-					break
-				} else {
-					scanInput.ExclusiveStartKey = out.LastEvaluatedKey
-				}
-
+			}
+			if out.LastEvaluatedKey == nil || len(out.LastEvaluatedKey) == 0 {
+				break
+			} else {
+				scanInput.ExclusiveStartKey = out.LastEvaluatedKey
 			}
 		}
 	}
@@ -147,24 +149,52 @@ func (i *InstrumentLoader) index(instr Instrument) {
 	i.instrumentsBySeq[id] = instr
 }
 
-func (i *InstrumentLoader) RandomInstrument() *Instrument {
-	instr, ok := i.instrumentsBySeq[rand.Int31n(i.loaded-1)]
+// renumber orders the instruments by ID, since the segments load in no particular order, so that the same
+// random source always picks the same instruments
+func (i *InstrumentLoader) renumber() {
+	ids := make([]string, 0, len(i.instrumentsByID))
+	for id := range i.instrumentsByID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	i.instrumentsBySeq = make(map[int32]Instrument, len(ids))
+	for idx, id := range ids {
+		i.instrumentsBySeq[int32(idx+1)] = i.instrumentsByID[id]
+	}
+}
+
+// random picks an instrument using the passed source, or the global source if it is nil. The sequence
+// numbers start at 1.
+func (i *InstrumentLoader) random(rnd *rand.Rand) (Instrument, bool) {
+	if i.loaded == 0 {
+		return Instrument{}, false
+	}
+	intn := rand.Int31n
+	if rnd != nil {
+		intn = rnd.Int31n
+	}
+	instr, ok := i.instrumentsBySeq[intn(i.loaded)+1]
+	return instr, ok
+}
+
+func (i *InstrumentLoader) RandomInstrument(rnd *rand.Rand) *Instrument {
+	instr, ok := i.random(rnd)
 	if ok {
 		return &instr
 	}
 	return nil
 }
 
-func (i *InstrumentLoader) RandomSymbol() *string {
-	instr, ok := i.instrumentsBySeq[rand.Int31n(i.loaded-1)]
+func (i *InstrumentLoader) RandomSymbol(rnd *rand.Rand) *string {
+	instr, ok := i.random(rnd)
 	if ok {
 		return &instr.Symbol
 	}
 	return nil
 }
 
-func (i *InstrumentLoader) RandomID() *string {
-	instr, ok := i.instrumentsBySeq[rand.Int31n(i.loaded-1)]
+func (i *InstrumentLoader) RandomID(rnd *rand.Rand) *string {
+	instr, ok := i.random(rnd)
 	if ok {
 		return &instr.InstrumentID
 	}
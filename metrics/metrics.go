@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"pql/util"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DefaultBuckets are the upper bounds, in seconds, of the latency histogram buckets
+	DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	lock     sync.Mutex
+	registry = make(map[string]metric)
+)
+
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+type funcMetric struct {
+	help     string
+	typeName string
+	fx       func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer, name string) {
+	writeHeader(w, name, m.help, m.typeName)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(m.fx()))
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	help    string
+	lock    *sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// CounterFunc registers a counter whose value is read from fx when the metrics are scraped
+func CounterFunc(name, help string, fx func() float64) {
+	register(name, &funcMetric{help: help, typeName: TYPE_COUNTER, fx: fx})
+}
+
+// GaugeFunc registers a gauge whose value is read from fx when the metrics are scraped
+func GaugeFunc(name, help string, fx func() float64) {
+	register(name, &funcMetric{help: help, typeName: TYPE_GAUGE, fx: fx})
+}
+
+// NewHistogram registers a histogram with the passed bucket upper bounds
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	var l sync.Mutex
+	h := &Histogram{
+		help:    help,
+		lock:    &l,
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for idx, upper := range h.buckets {
+		if v <= upper {
+			h.counts[idx]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince records the seconds elapsed since the passed time
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeHeader(w, name, h.help, TYPE_HISTOGRAM)
+	for idx, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(upper), h.counts[idx])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func register(name string, m metric) {
+	lock.Lock()
+	defer lock.Unlock()
+	registry[name] = m
+}
+
+func writeHeader(w *bufio.Writer, name, help, typeName string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typeName)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves all registered metrics in the Prometheus text exposition format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", CONTENT_TYPE)
+		w := bufio.NewWriter(rw)
+		lock.Lock()
+		names := make([]string, 0, len(registry))
+		for name := range registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			registry[name].write(w, name)
+		}
+		lock.Unlock()
+		w.Flush()
+	})
+}
+
+// Serve starts an HTTP listener on the passed address (e.g. ":9102" or "127.0.0.1:9102")
+// serving the metrics on /metrics, returning once the listener is bound
+func Serve(address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.New("Invalid metrics port: " + portStr)
+	}
+	if err := util.ValidateListener(port, host); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", util.NewAddress(port, host))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("WARNING: Metrics listener stopped: address=%s, error=%s\n", address, err.Error())
+		}
+	}()
+	log.Printf("Serving Metrics: http://%s/metrics\n", util.NewAddress(port, host))
+	return nil
+}
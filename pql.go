@@ -7,361 +7,406 @@ import (
 	"flag"
 	"fmt"
 	"github.com/andrew-d/go-termutil"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/panjf2000/ants/v2"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"pql/audit"
+	"pql/cli"
 	"pql/creds"
+	"pql/ddb"
+	"pql/executor"
+	"pql/guard"
+	"pql/metrics"
 	"pql/pqlfaker"
-	"pql/refsequence"
+	"pql/pqlquery"
+	"pql/truncate"
 	"pql/util"
-	"pql/version"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
 const (
-	MAX_BATCH_SIZE = 25
-	AWS_KEY_ENV    = "AWS_ACCESS_KEY_ID"
-	AWS_SECRET_ENV = "AWS_SECRET_ACCESS_KEY"
-	AWS_REGION_ENV = "AWS_REGION"
+	// Appended to an input's name for the file its SELECT results are written to
+	SELECT_OUTPUT_SUFFIX = ".out"
 )
 
 var (
-	enableFaker bool
-	noExec      bool
-	poolSize    int
-	statsFreq   int
-	maxRetries  int
-	profile     string
-	inFiles     []string
-	pool        *ants.Pool
-	freq        time.Duration
-
-	totalLines int
+	// The default command, which executes pql files as pql always has without a command
+	execCommand = &cli.Command{
+		Name:    "exec",
+		Summary: "Execute the PartiQL statements of pql files, or of stdin, in parallel batches",
+		Args:    "[file1 file2 .... fileN] (use - or no files to read stdin)",
+		Define:  defineExec,
+		Run:     runExec,
+	}
+
+	enableFaker    bool
+	noExec         bool
+	noCount        bool
+	noProgress     bool
+	ordered        bool
+	validate       bool
+	deadLetterName string
+	journalName    string
+	undoName       string
+	reportName     string
+	compression    string
+	resume         bool
+	override       bool
+	wcu            float64
+	rps            float64
+	paramStatement string
+	columns        []string
+	dataFormatName string
+	metricsAddress string
+	poolSize       int
+	statsFreq      int
+	drainSecs      int
+	maxRetries     int
+	inFiles        []string
+	shutdown       <-chan struct{}
+	freq           time.Duration
+	seed           int64
+	columnNames    string
+
+	totalLines = new(int64)
 	okFiles    int
+	linesLock  sync.Mutex
+	fileLines  = make(map[string]int) // The lines of each input counted so far
+	progress   *progressDisplay
 
-	dbAwsKeyId     string
-	dbAwsSecretKey string
-	dbAwsRegion    string
+	execConn cli.Connection // The comma separated profiles and regions of the targets, and the endpoint
+	targets  []target
 
-	rowsFailed      = new(int32)
-	batchesFailed   = new(int32)
-	executed        = new(int32)
-	retries         = new(int32)
-	inFlight        = new(int32)
-	capUsed         = new(int64)
-	executedBatches = new(int32)
+	run         *audit.Run
+	inputHashes = make(chan []audit.Input, 1)
 
 	dbClient *dynamodb.Client
+	exec     *executor.Executor
 
 	faker *pqlfaker.Faker
 
-	ONE       = int32(1)
-	MINUS_ONE = int32(-1)
+	deadLetter *executor.DeadLetter
+	journal    *executor.Journal
+	undo       *executor.Undo
+	schemas    *ddb.Schemas
+
+	batchLatency       *metrics.Histogram
+	transactionLatency *metrics.Histogram
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
-	cores := runtime.NumCPU()
-	runtime.GOMAXPROCS(cores)
-	flag.IntVar(&poolSize, "pool", cores*10, "The size of the thread pool for executing PartiQL batches")
-	flag.IntVar(&statsFreq, "stats", 10, "The period on which stats are printed in seconds")
-	flag.StringVar(&profile, "profile", "", "The optional AWS shared config credential profile name")
-	flag.IntVar(&maxRetries, "maxretries", -1, "The maximum number of retries for a failed batch write (-1 for infinite)")
-	flag.BoolVar(&enableFaker, "faker", false, "Specify to enable faker test data generation and token substitution")
-	flag.BoolVar(&noExec, "noexec", false, "Specify to disable statement execution, but just output the statements as a dry run")
-
-	usage := flag.Usage
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "pql: v%s\n", version.VERSION)
-		fmt.Fprintf(os.Stderr, "Parameters: pql [options] [file1 file2 .... fileN]\n")
-		usage()
-	}
-	flag.Parse()
-	freq = time.Duration(statsFreq) * time.Second
-	log.Printf("Stats Frequency: %s\n", freq.String())
-	inFiles = flag.Args()
+	runtime.GOMAXPROCS(runtime.NumCPU())
+}
 
-	if profile != "" {
-		pcfg, err := creds.GetProfileCreds(profile)
-		if err != nil {
-			fmt.Printf("ERROR: Failed to load credentials for profile [%s]: %s\n", profile, err.Error())
-			os.Exit(-10)
-		}
-		//fmt.Printf("Loaded Profile: source=%s\n", pcfg[0])
-		dbAwsKeyId = pcfg[1]
-		dbAwsSecretKey = pcfg[2]
-		dbAwsRegion = pcfg[3]
-	} else {
-		dbAwsKeyId = util.Env("", AWS_KEY_ENV)
-		dbAwsSecretKey = util.Env("", AWS_SECRET_ENV)
-		dbAwsRegion = util.Env("us-east-1", AWS_REGION_ENV)
-	}
+func main() {
+	cli.Main(execCommand, pqlquery.Command, truncate.Command, seqCommand, describeCommand)
+}
 
-	pool, _ = ants.NewPool(poolSize, ants.WithPreAlloc(true))
+func defineExec(fs *flag.FlagSet) {
+	cores := runtime.NumCPU()
+	fs.IntVar(&poolSize, "pool", cores*10, "The size of the thread pool for executing PartiQL batches")
+	fs.IntVar(&statsFreq, "stats", 10, "The period on which stats are printed in seconds")
+	fs.IntVar(&drainSecs, "drain", 30, "The maximum time in seconds to wait for in-flight batches to complete after SIGINT or SIGTERM")
+	execConn.Flags(fs)
+	// The inputs are executed against each of the profiles and regions in turn
+	fs.Lookup("profile").Usage = "The optional AWS shared config credential profile name, or comma separated names to execute against each in turn"
+	fs.Lookup("region").Usage = "The optional AWS region overriding the profile's region, or comma separated regions to execute against each in turn"
+	fs.IntVar(&maxRetries, "maxretries", -1, "The maximum number of retries for a failed batch write (-1 for infinite)")
+	fs.BoolVar(&enableFaker, "faker", false, "Specify to enable faker test data generation and token substitution")
+	fs.Int64Var(&seed, "seed", 0, "The seed for faker test data generation, logged on every run so the same data can be generated again (0 for a random seed)")
+	fs.BoolVar(&noExec, "noexec", false, "Specify to disable statement execution, but just output the statements as a dry run")
+	fs.BoolVar(&noCount, "nocount", false, "Specify to skip counting the lines of the input files in the background")
+	fs.BoolVar(&noProgress, "noprogress", false, "Specify to print periodic progress lines rather than a progress bar when stderr is a terminal")
+	fs.BoolVar(&validate, "validate", false, "Specify to check the input statements against the table key schemas and report any problems without executing them")
+	fs.StringVar(&deadLetterName, "deadletter", "", "The optional name of a file to write failed statements to, which can be re-executed by pql")
+	fs.BoolVar(&ordered, "ordered", false, "Specify to execute statements for the same item in input order, while statements for other items still run in parallel")
+	fs.StringVar(&journalName, "journal", "", "The optional name of a file to record completed batches in")
+	fs.StringVar(&undoName, "undo", "", "The optional name of a file to write statements reversing each applied statement to, which can be executed by pql to roll back the run")
+	fs.Float64Var(&wcu, "wcu", 0, "The optional target write capacity units consumed per second, adjusted down automatically when throttled")
+	fs.Float64Var(&rps, "rps", 0, "The optional target statements executed per second, adjusted down automatically when throttled")
+	fs.StringVar(&paramStatement, "statement", "", "The optional PartiQL statement with ? placeholders to execute once per row of the input data files (CSV or JSONL)")
+	fs.StringVar(&columnNames, "columns", "", "The optional comma separated data columns bound to the -statement placeholders, in order")
+	fs.StringVar(&dataFormatName, "dataformat", "", "The optional format of the -statement data files (csv or jsonl), inferred if not specified")
+	fs.StringVar(&metricsAddress, "metrics", "", "The optional address to serve Prometheus metrics on (e.g. :9102)")
+	fs.BoolVar(&resume, "resume", false, "Specify to skip the batches recorded as completed in the -journal file by a previous run")
+	fs.StringVar(&compression, "compress", "", "The optional compression (gzip or zstd) of the dead letter, undo and SELECT output files, which are given a .gz or .zst extension")
+	fs.BoolVar(&override, guard.OVERRIDE_FLAG, false, guard.OVERRIDE_USAGE)
+	fs.StringVar(&reportName, "report", "", "The optional name of a file to write a JSON report of the run to, with the totals for each input, table and operation")
 }
 
-func saveStdIn() string {
-	if termutil.Isatty(os.Stdin.Fd()) {
-		return ""
-	}
-	if f, err := ioutil.TempFile(os.TempDir(), "pql-tmp"); err != nil {
-		//log.Fatalf("Failed to save stdin to file: error=%s\n", err.Error())
-		return "" // not called
-	} else {
-		defer f.Close()
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			s := scanner.Text()
-			f.WriteString(s + "\n")
+// runExec executes the input files against each target in turn
+func runExec(fs *flag.FlagSet) {
+	if columnNames != "" {
+		for _, col := range strings.Split(columnNames, ",") {
+			columns = append(columns, strings.TrimSpace(col))
 		}
-		return f.Name()
 	}
-}
+	if dataFormatName != "" && dataFormatName != executor.DATA_FORMAT_CSV && dataFormatName != executor.DATA_FORMAT_JSONL {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid -dataformat: %s\n", dataFormatName)
+		os.Exit(-9)
+	}
+	if compression != "" && compression != executor.COMPRESSION_GZIP && compression != executor.COMPRESSION_ZSTD {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid -compress: %s\n", compression)
+		os.Exit(-9)
+	}
+	deadLetterName = compressedName(deadLetterName)
+	undoName = compressedName(undoName)
+	if resume && journalName == "" {
+		fmt.Fprintf(os.Stderr, "ERROR: -resume requires a -journal file\n")
+		os.Exit(-9)
+	}
+	freq = time.Duration(statsFreq) * time.Second
+	log.Printf("Stats Frequency: %s\n", freq.String())
+	inFiles = fs.Args()
 
-func getRefSequence() {
-	// "accountNo", "ZA", count, false
-	rs, _ := refsequence.NewRefSequence(dbClient)
-	//if seqs, err := rs.GetRefSequences("accountNo", "ZRDA", 3, false); err != nil {
-	//if seqs, err := rs.GetRefSequencesWithWLP("orderNo", "ZRDA", 3, false); err != nil {
-	if seqs, err := rs.GetRefSequences("orderNo", 300); err != nil {
-		log.Printf("Failed to get ref-sequences: error=%s\n", err.Error())
+	if t, err := loadTargets(execConn.Profile, execConn.Region); err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(-10)
 	} else {
-		for idx, seq := range seqs {
-			log.Printf("%d: %s (%d)\n", idx, seq, len(seq))
-		}
+		targets = t
 	}
-	os.Exit(1)
-}
 
-func main() {
-	tmpFile := saveStdIn()
-	if tmpFile != "" {
-		inFiles = append(inFiles, tmpFile)
-		defer os.Remove(tmpFile)
+	if len(inFiles) == 0 && !termutil.Isatty(os.Stdin.Fd()) {
+		inFiles = append(inFiles, executor.STDIN_NAME)
 	}
 	if len(inFiles) == 0 {
 		fmt.Fprintf(os.Stderr, "ERROR: No input files specified\n")
 		os.Exit(-9)
 	}
 
-	//if termutil.Isatty(os.Stdin.Fd()) {
-	//	log.Printf("Reading StdIn\n")
-	//	tmpFile := saveStdIn()
-	//	inFiles = append(inFiles, tmpFile)
-	//	defer os.Remove(tmpFile)
-	//}
-	//defer ants.Release()
-	totalLines, okFiles = evalFiles(inFiles)
+	inFiles = evalFiles(inFiles)
+	okFiles = len(inFiles)
 	if okFiles < 1 {
 		fmt.Fprintf(os.Stderr, "ERROR: No valid input files specified\n")
 		os.Exit(-9)
 	}
-	log.Printf("Input Files: count=%d, totalLines=%d\n", okFiles, totalLines)
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(dbAwsRegion),
-		config.WithCredentialsProvider(creds.NewChainedCredentialProvider(
-			credentials.NewStaticCredentialsProvider(dbAwsKeyId, dbAwsSecretKey, ""),
-			ec2rolecreds.New(),
-		)),
-	)
-
-	if err != nil {
-		log.Fatalf("unable to load SDK config, %v", err)
+	log.Printf("Input Files: count=%d\n", okFiles)
+	if len(targets) > 1 {
+		for _, name := range inFiles {
+			if name == executor.STDIN_NAME {
+				fmt.Fprintf(os.Stderr, "ERROR: Stdin can only be read once, so it cannot be executed against several targets\n")
+				os.Exit(-9)
+			}
+		}
+	}
+	if !noExec && !validate {
+		confirmTargets()
+	}
+	if !validate {
+		run = audit.NewRun("pql")
+		go func() {
+			inputHashes <- audit.HashInputs(inFiles)
+		}()
+	}
+	if !noCount {
+		go countLines(inFiles)
 	}
 
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-			reportStats(false)
+	if validate {
+		problems := 0
+		for idx := range targets {
+			connect(&targets[idx])
+			problems += validateFiles(inFiles)
 		}
-	}()
-
-	// Using the Config value, create the DynamoDB client
-	dbClient = dynamodb.NewFromConfig(cfg)
+		if problems > 0 {
+			os.Exit(-9)
+		}
+		os.Exit(0)
+	}
 
 	if enableFaker {
-		if f, err := pqlfaker.NewFaker(dbClient); err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: Failed to initialize Faker: error=%s\n", err.Error())
-			os.Exit(-9)
-		} else {
-			faker = f
+		if seed == 0 {
+			seed = time.Now().UnixNano()
 		}
+		log.Printf("Faker Seed: seed=%d\n", seed)
 	}
 
-	var globalWg sync.WaitGroup
-	globalWg.Add(okFiles)
-	startTime := time.Now()
-	for _, fileName := range inFiles {
-		fname := fileName
-		pool.Submit(func() { // FIXME
-			processFile(fname, &globalWg)
-		})
+	cli.ServeMetrics(metricsAddress, func() {
+		batchLatency = metrics.NewHistogram("pql_batch_latency_seconds", "The latency of BatchExecuteStatement calls", metrics.DefaultBuckets)
+		transactionLatency = metrics.NewHistogram("pql_transaction_latency_seconds", "The latency of ExecuteTransaction calls", metrics.DefaultBuckets)
+		registerMetrics()
+	})
+
+	// On a terminal a progress bar replaces the periodic progress lines, unless the statements are echoed to it
+	echo := (enableFaker || noExec) && termutil.Isatty(os.Stdout.Fd())
+	if !noProgress && !echo && termutil.Isatty(os.Stderr.Fd()) {
+		progress = newProgressDisplay(os.Stderr)
+		log.SetOutput(progress)
+		go progress.run()
+	} else {
+		cli.ReportEvery(freq, reportStats)
 	}
-	log.Printf("All files in process\n")
-	globalWg.Wait()
-	pool.Release()
-	reportStats(true)
-	log.Printf("Done. Elapsed=%s\n", time.Since(startTime))
 
-	os.Exit(0)
+	startTime = time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown = util.NotifyShutdown(func(sig os.Signal, again bool) {
+		if again {
+			// The first shutdown may be stuck draining or flushing, so nothing here may wait on it
+			log.Printf("Exiting Without Draining: signal=%s\n", sig)
+			os.Exit(EXIT_INTERRUPTED)
+		}
+		log.Printf("Shutdown Requested: signal=%s, stopping input and draining in-flight batches (signal again to exit now)\n", sig)
+		cancel()
+	})
+	for idx := range targets {
+		if util.IsClosed(shutdown) {
+			break
+		}
+		runTarget(ctx, &targets[idx])
+	}
+	status := 0
+	if util.IsClosed(shutdown) {
+		status = EXIT_INTERRUPTED
+	}
+	finish(startTime, status)
+	os.Exit(status)
 
 }
 
-func processFile(fileName string, globalWg *sync.WaitGroup) {
-	defer globalWg.Done()
-	file, err := os.Open(fileName)
+// connect creates the DynamoDB client for a target
+func connect(t *target) {
+	if len(targets) > 1 {
+		log.Printf("Target: name=%s, region=%s\n", t.name, t.region)
+	}
+	if t.operator == nil {
+		t.operator = &audit.Operator{}
+	}
+	cfg, err := creds.LoadConfigWithRef(t.region, t.key, t.secret, execConn.Endpoint, t.operator.Set)
+
 	if err != nil {
-		panic(err)
+		exitFailed(-9, "Failed to load SDK config: target=%s, error=%s", t.name, err.Error())
 	}
-	defer func() {
-		closeFile(file)
-	}()
-	scanner := bufio.NewScanner(file)
-	arr := make([]types.BatchStatementRequest, 0, MAX_BATCH_SIZE)
-	currentBatchSize := 0
-	var fileWg sync.WaitGroup
-	for scanner.Scan() {
-		st := strings.TrimSpace(scanner.Text())
-		if len(st) == 0 {
-			continue
-		}
-		if strings.HasPrefix(st, "#") {
-			continue
-		}
 
-		doBreak := strings.ToLower(strings.TrimSpace(st)) == "break"
-		if !doBreak {
-			req := types.BatchStatementRequest{
-				Statement: aws.String(st),
-			}
-			arr = append(arr, req)
-			currentBatchSize++
-		}
-		if doBreak || len(arr) == MAX_BATCH_SIZE {
-			currentBatchSize = 0
-			arrCopy := arr
-			arr = make([]types.BatchStatementRequest, 0, MAX_BATCH_SIZE)
-			if len(arrCopy) > 0 {
-				fileWg.Add(1)
-				pool.Submit(func() { // FIXME: handle possible pool failure
-					defer fileWg.Done()
-					submitBatch(arrCopy)
-				})
-			}
+	// Using the Config value, create the DynamoDB client
+	dbClient = dynamodb.NewFromConfig(cfg)
+	schemas = ddb.NewSchemas(dbClient)
+}
+
+// runTarget executes every input file against a target, returning once they are complete, or drained
+// after a shutdown was requested
+func runTarget(ctx context.Context, t *target) {
+	t.started = time.Now()
+	connect(t)
+	var f *pqlfaker.Faker
+	if enableFaker {
+		if fk, err := pqlfaker.NewFaker(dbClient); err != nil {
+			exitFailed(-9, "Failed to initialize Faker: error=%s", err.Error())
+		} else {
+			f = fk
 		}
 	}
-	if currentBatchSize > 0 {
-		fileWg.Add(1)
-		pool.Submit(func() { // FIXME: handle possible pool failure
-			defer fileWg.Done()
-			submitBatch(arr)
-		})
+
+	var d *executor.DeadLetter
+	if deadLetterName != "" {
+		name := targetFileName(deadLetterName, t)
+		if dl, err := executor.NewDeadLetter(name); err != nil {
+			exitFailed(-9, "Failed to create dead letter file: file=%s, error=%s", name, err.Error())
+		} else {
+			d = dl
+		}
 	}
-	fileWg.Wait()
-	log.Printf("File Processing Complete: %s\n", fileName)
-}
 
-func submitBatch(arrCopy []types.BatchStatementRequest) {
-	retryCount := 0
-	atomic.AddInt32(inFlight, ONE)
-	defer func() {
-		atomic.AddInt32(inFlight, MINUS_ONE)
-		if retryCount > 0 {
-			atomic.AddInt32(retries, int32(retryCount))
+	var j *executor.Journal
+	if journalName != "" {
+		name := targetFileName(journalName, t)
+		if jn, err := executor.NewJournal(name, resume); err != nil {
+			d.Close()
+			exitFailed(-9, "Failed to open journal file: file=%s, error=%s", name, err.Error())
+		} else {
+			j = jn
 		}
-	}()
+	}
 
-	for {
-		failedCommands, err := executeBatch(dbClient, arrCopy)
-		if err != nil {
-			// Whole batch failed, not cap related
-			atomic.AddInt32(batchesFailed, int32(len(arrCopy)))
-			break
+	var u *executor.Undo
+	if undoName != "" && !noExec {
+		name := targetFileName(undoName, t)
+		if un, err := executor.NewUndo(name); err != nil {
+			d.Close()
+			j.Close()
+			exitFailed(-9, "Failed to create undo file: file=%s, error=%s", name, err.Error())
 		} else {
-			if failedCommands != nil && len(failedCommands) > 0 {
-				atomic.AddInt32(executed, int32(len(arrCopy))-int32(len(failedCommands)))
-				retryCount++
-				if maxRetries > 0 {
-					if retryCount > maxRetries {
-						// Retries Exhausted, fail all rows
-						atomic.AddInt32(rowsFailed, int32(len(arrCopy)))
-						break
-					} else {
-						// Retries not exhausted yet
-						arrCopy = failedCommands
-						continue
-					}
-				} else {
-					// Retrying indefinitely
-					arrCopy = failedCommands
-					continue
-				}
-			} else {
-				// All rows successful
-				atomic.AddInt32(executed, int32(len(arrCopy)))
-				break
-			}
+			u = un
 		}
 	}
-	atomic.AddInt32(executedBatches, ONE)
-	return
-}
 
-func executeBatch(client *dynamodb.Client, commands []types.BatchStatementRequest) (capFailedCommands []types.BatchStatementRequest, err error) {
-	failedArr := make([]types.BatchStatementRequest, 0)
-	if enableFaker {
-		for idx, cmd := range commands {
-			v := faker.Substitute(cmd.Statement)
-			cmd.Statement = v
-			fmt.Printf("%s\n", *v)
-			commands[idx] = cmd
+	x, err := executor.New(executor.Options{
+		Client:      dbClient,
+		Concurrency: poolSize,
+		MaxRetries:  maxRetries,
+		NoExec:      noExec,
+		Ordered:     ordered,
+		Faker:       f,
+		Seed:        seed,
+		Echo:        os.Stdout,
+		Inputs:      inFiles,
+		WCU:         wcu,
+		RPS:         rps,
+		SelectOutput: func(name string) (io.WriteCloser, error) {
+			return selectOutput(name, t)
+		},
+		Statement:          paramStatement,
+		Columns:            columns,
+		DataFormat:         dataFormatName,
+		DeadLetter:         d,
+		Journal:            j,
+		Undo:               u,
+		BatchLatency:       batchLatency,
+		TransactionLatency: transactionLatency,
+	})
+	if err != nil {
+		d.Close()
+		j.Close()
+		u.Close()
+		exitFailed(-9, "Failed to create executor: error=%s", err.Error())
+	}
+	targetLock.Lock()
+	current, exec, faker, deadLetter, journal, undo = t, x, f, d, j, u
+	targetLock.Unlock()
+	progress.start()
 
-		}
-		if noExec {
-			return nil, nil
-		}
+	var globalWg sync.WaitGroup
+	globalWg.Add(okFiles)
+	for _, fileName := range inFiles {
+		// Files are read outside of the pool, which applies backpressure to them by blocking in Submit
+		// while every worker is busy executing batches
+		go processFile(ctx, x, fileName, &globalWg)
 	}
-	var totalCap = int64(0)
-	if out, batchErr := client.BatchExecuteStatement(context.TODO(), &dynamodb.BatchExecuteStatementInput{
-		Statements:             commands,
-		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
-	}); batchErr != nil {
-		//log.Fatalf("Batch Write Failed: error=%s\n", batchErr.Error())
-		return nil, batchErr
-	} else {
-		if len(out.ConsumedCapacity) > 0 {
-			for _, cc := range out.ConsumedCapacity {
-				if cc.CapacityUnits != nil {
-					//atomic.AddInt64(_capUsed, int64(*out.ConsumedCapacity[0].CapacityUnits))
-					totalCap += int64(*cc.CapacityUnits)
-				}
-			}
-		}
-		for idx, rez := range out.Responses {
-			if rez.Error != nil {
-				if rez.Error.Code == "ThrottlingError" {
-					failedArr = append(failedArr, commands[idx])
-				}
-			}
+	log.Printf("All files in process\n")
+	done := make(chan struct{})
+	go func() {
+		globalWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdown:
+		if util.WaitTimeout(&globalWg, time.Duration(drainSecs)*time.Second) {
+			log.Printf("WARNING: Timed out draining in-flight batches: timeout=%ds, inflight=%d\n", drainSecs, x.Stats().InFlight)
 		}
+	}
+	x.Close()
+	closeTarget()
+}
 
+func processFile(ctx context.Context, x *executor.Executor, fileName string, globalWg *sync.WaitGroup) {
+	defer globalWg.Done()
+	result, err := x.ExecuteFile(ctx, fileName)
+	if err != nil {
+		log.Printf("ERROR: Failed to process file: file=%s, error=%s\n", fileName, err.Error())
+	}
+	recordResult(result)
+	if result != nil && result.StoppedLine > 0 {
+		recordStop(fileName, result.StoppedLine)
 	}
-	atomic.AddInt64(capUsed, totalCap)
-	return failedArr, nil
 }
 
 func closeFile(file *os.File) {
@@ -374,48 +419,178 @@ func closeFile(file *os.File) {
 }
 
 func reportStats(final bool) {
+	if t, st := currentStats(); t != nil {
+		printStats(t, st, final)
+	}
+}
+
+func printStats(t *target, st executor.Stats, final bool) {
 	if noExec {
 		if final {
 			log.Printf("No statement executed (-noexec was enabled)")
 		}
 	} else {
+		name := ""
+		if len(targets) > 1 {
+			name = "target=" + t.name + ", "
+		}
 		if final {
-			log.Printf("Final Status: rowsprocessed=%d, batches=%d, failed=%d, retries=%d, cap=%d, poolbusy=%d, inflight=%d\n",
-				atomic.LoadInt32(executed), atomic.LoadInt32(executedBatches), atomic.LoadInt32(rowsFailed), atomic.LoadInt32(retries), atomic.LoadInt64(capUsed), pool.Running(), atomic.LoadInt32(inFlight),
+			log.Printf("Final Status: %srowsprocessed=%d, batches=%d, failed=%d, retries=%d, cap=%d, poolbusy=%d, inflight=%d%s\n",
+				name, st.Executed, st.Batches, st.Failed, st.Retries, st.CapacityUnits, st.PoolRunning, st.InFlight, rateStatus(st),
 			)
 		} else {
-			log.Printf("Progress: rowsprocessed=%d, batches=%d, failed=%d, retries=%d, cap=%d, poolbusy=%d, inflight=%d\n",
-				atomic.LoadInt32(executed), atomic.LoadInt32(executedBatches), atomic.LoadInt32(rowsFailed), atomic.LoadInt32(retries), atomic.LoadInt64(capUsed), pool.Running(), atomic.LoadInt32(inFlight),
+			log.Printf("Progress: %srowsprocessed=%d, batches=%d, failed=%d, retries=%d, cap=%d, poolbusy=%d, inflight=%d%s\n",
+				name, st.Executed, st.Batches, st.Failed, st.Retries, st.CapacityUnits, st.PoolRunning, st.InFlight, rateStatus(st),
 			)
 		}
 	}
 }
 
-func evalFiles(names []string) (int, int) {
-	lines := 0
-	ok := 0
+func registerMetrics() {
+	stat := totalStats
+	metrics.CounterFunc("pql_statements_executed_total", "The number of statements executed", func() float64 {
+		return float64(stat().Executed)
+	})
+	metrics.CounterFunc("pql_statements_failed_total", "The number of statements that failed", func() float64 {
+		return float64(stat().Failed)
+	})
+	metrics.CounterFunc("pql_batches_executed_total", "The number of batches and transactions executed", func() float64 {
+		return float64(stat().Batches)
+	})
+	metrics.CounterFunc("pql_batches_failed_total", "The number of batches that failed as a whole", func() float64 {
+		return float64(stat().BatchesFailed)
+	})
+	metrics.CounterFunc("pql_retries_total", "The number of batch and transaction retries", func() float64 {
+		return float64(stat().Retries)
+	})
+	metrics.CounterFunc("pql_capacity_units_total", "The capacity units consumed", func() float64 {
+		return float64(stat().CapacityUnits)
+	})
+	metrics.GaugeFunc("pql_inflight_batches", "The number of batches and transactions being executed", func() float64 {
+		return float64(stat().InFlight)
+	})
+	metrics.GaugeFunc("pql_pool_running", "The number of busy pool workers", func() float64 {
+		return float64(stat().PoolRunning)
+	})
+	metrics.GaugeFunc("pql_input_lines", "The total number of lines in the input files", func() float64 {
+		return float64(atomic.LoadInt64(totalLines))
+	})
+	if wcu > 0 {
+		metrics.GaugeFunc("pql_wcu_rate", "The enforced write capacity units per second", func() float64 {
+			return stat().WCURate
+		})
+	}
+	if rps > 0 {
+		metrics.GaugeFunc("pql_rps_rate", "The enforced statements per second", func() float64 {
+			return stat().RPSRate
+		})
+	}
+}
+
+// rateStatus returns the currently enforced rate limits for the stats line, if any are enabled
+func rateStatus(st executor.Stats) string {
+	status := ""
+	if wcu > 0 {
+		status += fmt.Sprintf(", wcurate=%.1f", st.WCURate)
+	}
+	if rps > 0 {
+		status += fmt.Sprintf(", rpsrate=%.1f", st.RPSRate)
+	}
+	return status
+}
+
+// selectOutput creates the file the SELECT results of an input are written to, named after the input with
+// a .out suffix (and the target, when there are several, and the -compress extension). The results of a SELECT read from stdin are
+// written to stdout.
+func selectOutput(name string, t *target) (io.WriteCloser, error) {
+	if name == executor.STDIN_NAME {
+		return stdoutOutput{bufio.NewWriter(os.Stdout)}, nil
+	}
+	// The output of a compressed input is named after the input without its compression extension
+	if executor.CompressionOf(name) != "" {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	o, err := executor.CreateOutput(targetFileName(compressedName(name+SELECT_OUTPUT_SUFFIX), t))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Select Output: file=%s\n", o.Name())
+	return o, nil
+}
+
+// compressedName adds the -compress extension to an output file name, if it does not have one already
+func compressedName(name string) string {
+	if name == "" || executor.CompressionOf(name) != "" {
+		return name
+	}
+	switch compression {
+	case executor.COMPRESSION_GZIP:
+		return name + executor.GZIP_EXTENSION
+	case executor.COMPRESSION_ZSTD:
+		return name + executor.ZSTD_EXTENSION
+	}
+	return name
+}
+
+// stdoutOutput buffers the SELECT results written to stdout, which is left open on Close
+type stdoutOutput struct {
+	*bufio.Writer
+}
+
+func (o stdoutOutput) Close() error {
+	return o.Flush()
+}
+
+// evalFiles returns the input files that can be read, warning about the others
+func evalFiles(names []string) []string {
+	ok := make([]string, 0, len(names))
 	for _, name := range names {
-		if l, err := lineCounter(name); err == nil {
-			lines += l
-			ok++
+		if name == executor.STDIN_NAME {
+			ok = append(ok, name)
+		} else if _, err := os.Stat(name); err == nil {
+			ok = append(ok, name)
 		} else {
 			log.Printf("WARNING: Failed to open file: name=%s, error=%s\n", name, err.Error())
 		}
 	}
-	return lines, ok
+	return ok
+}
+
+// countLines totals the lines of the regular input files while they are being executed. Stdin and
+// named pipes can only be read once, so they are not counted.
+func countLines(names []string) {
+	startTime := time.Now()
+	for _, name := range names {
+		if name == executor.STDIN_NAME {
+			continue
+		}
+		if info, err := os.Stat(name); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if l, err := lineCounter(name); err == nil {
+			linesLock.Lock()
+			if _, ok := fileLines[name]; !ok {
+				fileLines[name] = l
+				atomic.AddInt64(totalLines, int64(l))
+			}
+			linesLock.Unlock()
+		} else {
+			log.Printf("WARNING: Failed to count file lines: name=%s, error=%s\n", name, err.Error())
+		}
+	}
+	log.Printf("Input Lines: totalLines=%d, elapsed=%s\n", atomic.LoadInt64(totalLines), time.Since(startTime))
 }
 
 func lineCounter(fileName string) (int, error) {
 	buf := make([]byte, 32*1024)
 	count := 0
 	lineSep := []byte{'\n'}
-	f, ferr := os.Open(fileName)
+	// Compressed inputs are counted as they are executed, decompressed
+	f, ferr := executor.OpenInput(fileName)
 	if ferr != nil {
 		return -1, ferr
 	}
-	defer func() {
-		closeFile(f)
-	}()
+	defer f.Close()
 	for {
 		c, err := f.Read(buf)
 		count += bytes.Count(buf[:c], lineSep)
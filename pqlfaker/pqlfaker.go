@@ -5,21 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/jaswdr/faker"
 	"log"
 	"math/rand"
+	"pql/config"
 	"pql/ddb"
 	"pql/instrument"
 	"pql/refsequence"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	ISO_FORMAT = "2006-02-01T15:04:05.000Z"
+	ISO_FORMAT = "2006-01-02T15:04:05.000Z"
 )
 
 type NoParamFunc func() string
@@ -29,6 +32,7 @@ func init() {
 }
 
 var (
+	// The tables random accounts and users are read from, mapped by the environment's config
 	accountsTable = "bo.accounts"
 	usersTable    = "bo.users"
 
@@ -45,20 +49,30 @@ type Faker struct {
 	dbFakers    map[string]func(state map[string]map[string]string, args ...string) string
 	noParamOps  map[string]NoParamFunc
 	f           faker.Faker
+	rnd         *rand.Rand
+}
+
+// uuid returns a version 4 UUID formatted like faker's, which reads crypto/rand and so ignores the seed
+func (f *Faker) uuid() string {
+	var b [16]byte
+	f.rnd.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant RFC4122
+	return fmt.Sprintf("%x%x%x%x%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 func (f *Faker) uuidAV(keys ...string) map[string]types.AttributeValue {
 	size := len(keys)
 	m := make(map[string]types.AttributeValue, size)
 	for _, key := range keys {
-		m[key] = &types.AttributeValueMemberS{Value: f.f.UUID().V4()}
+		m[key] = &types.AttributeValueMemberS{Value: f.uuid()}
 	}
 	return m
 }
 
-func randomSide() string {
+func (f *Faker) randomSide() string {
 	side := ""
-	if rand.Intn(1) == 0 {
+	if f.rnd.Intn(2) == 0 {
 		side = "B"
 	} else {
 		side = "S"
@@ -66,14 +80,14 @@ func randomSide() string {
 	return side
 }
 
-func randomDuration() time.Duration {
+func (f *Faker) randomDuration() time.Duration {
 	sign := ""
-	if rand.Intn(1) == 0 {
+	if f.rnd.Intn(2) == 0 {
 		sign = "-"
 	} else {
 		sign = "+"
 	}
-	d, _ := time.ParseDuration(sign + fmt.Sprintf("%ds", rand.Intn(100000)))
+	d, _ := time.ParseDuration(sign + fmt.Sprintf("%ds", f.rnd.Intn(100000)))
 	return d
 }
 
@@ -85,7 +99,7 @@ func (f *Faker) randomAccount(dbClient *dynamodb.Client, excludeAccountIDs ...st
 	}
 
 	if out, err := dbClient.Scan(context.Background(), &dynamodb.ScanInput{
-		TableName:         &accountsTable,
+		TableName:         aws.String(config.TableName(accountsTable)),
 		ExclusiveStartKey: f.uuidAV("accountID", "userID"),
 	}); err != nil {
 		return nil, err
@@ -114,7 +128,7 @@ func (f *Faker) randomUser(dbClient *dynamodb.Client, excludeUserIDs ...string)
 	}
 
 	if out, err := dbClient.Scan(context.Background(), &dynamodb.ScanInput{
-		TableName:         &usersTable,
+		TableName:         aws.String(config.TableName(usersTable)),
 		ExclusiveStartKey: f.uuidAV("userID"),
 	}); err != nil {
 		return nil, err
@@ -159,7 +173,7 @@ func (f *Faker) buildOps(refSeq *refsequence.RefSequence, dbClient *dynamodb.Cli
 			acc, ok = state["new-user-account"]
 			if !ok {
 				acc = make(map[string]string, 3)
-				uid := f.f.UUID().V4()
+				uid := f.uuid()
 				ts := fmt.Sprintf("%d", AbsInt64(f.f.Int64()))
 				acc["userID"] = uid + "." + ts
 				acc["accountID"] = uid
@@ -260,8 +274,8 @@ func (f *Faker) buildOps(refSeq *refsequence.RefSequence, dbClient *dynamodb.Cli
 			var ok bool
 			acc, ok = state["random-instrument"]
 			if !ok {
-				acc := f.instruments.RandomInstrument().ToMap()
-				if acc != nil {
+				if instr := f.instruments.RandomInstrument(f.rnd); instr != nil {
+					acc = instr.ToMap()
 					state["random-instrument"] = acc
 				}
 			}
@@ -286,15 +300,36 @@ func NewFaker(dbClient *dynamodb.Client) (*Faker, error) {
 		return nil, err
 	} else {
 		fk := &Faker{
-			f:           faker.NewWithSeed(rand.NewSource(rand.Int63())),
 			dbClient:    dbClient,
 			refSeq:      ref,
 			instruments: instrument.NewInstrumentLoader(dbClient).Load(),
 		}
-		fk.dbFakers = fk.buildOps(ref, dbClient)
-		fk.noParamOps = fk.buildNoParamOps()
-		return fk, nil
+		return fk.WithSeed(rand.Int63()), nil
+	}
+}
+
+// WithSeed returns a Faker sharing the loaded reference data that draws every random value from the
+// passed seed, so the same seed always produces the same substitutions. Values based on the clock or on
+// the ref.sequences counters still differ between runs. A Faker must not be used concurrently, so give
+// each goroutine its own.
+func (f *Faker) WithSeed(seed int64) *Faker {
+	src := rand.NewSource(seed)
+	rnd := rand.New(src)
+	fk := &Faker{
+		f:           faker.NewWithSeed(src),
+		rnd:         rnd,
+		dbClient:    f.dbClient,
+		refSeq:      f.refSeq.WithRand(rnd),
+		instruments: f.instruments,
 	}
+	fk.dbFakers = fk.buildOps(fk.refSeq, fk.dbClient)
+	fk.noParamOps = fk.buildNoParamOps()
+	return fk
+}
+
+// Reseed restarts the random values of a Faker from the passed seed, as if it was created by WithSeed
+func (f *Faker) Reseed(seed int64) {
+	f.rnd.Seed(seed)
 }
 
 func (f *Faker) buildNoParamOps() map[string]NoParamFunc {
@@ -327,10 +362,10 @@ func (f *Faker) buildNoParamOps() map[string]NoParamFunc {
 			return f.f.Phone().Number()
 		},
 		"##isotime##": func() string {
-			return time.Now().Add(randomDuration()).Format(ISO_FORMAT)
+			return time.Now().Add(f.randomDuration()).Format(ISO_FORMAT)
 		},
 		"##uuid##": func() string {
-			return f.f.UUID().V4()
+			return f.uuid()
 		},
 		"##int##": func() string {
 			return fmt.Sprintf("%d", AbsInt(f.f.Int()))
@@ -339,7 +374,7 @@ func (f *Faker) buildNoParamOps() map[string]NoParamFunc {
 			return fmt.Sprintf("%d", AbsInt64(f.f.Int64()))
 		},
 		"##float##": func() string {
-			return fmt.Sprintf("%d", AbsFloat32(f.f.Float32(8, 0, 99999999)))
+			return strconv.FormatFloat(float64(AbsFloat32(f.f.Float32(8, 0, 99999999))), 'f', -1, 32)
 		},
 		"##bool##": func() string {
 			return fmt.Sprintf("%t", f.f.Bool())
@@ -351,10 +386,10 @@ func (f *Faker) buildNoParamOps() map[string]NoParamFunc {
 			return f.f.Internet().Email()
 		},
 		"##userid##": func() string {
-			return f.f.UUID().V4()
+			return f.uuid()
 		},
 		"##accountID##": func() string {
-			return f.f.UUID().V4() + "." + fmt.Sprintf("%d", AbsInt64(f.f.Int64()))
+			return f.uuid() + "." + fmt.Sprintf("%d", AbsInt64(f.f.Int64()))
 		},
 		"##monthcode##": func() string {
 			return refsequence.CurrentMonthCode()
@@ -363,23 +398,23 @@ func (f *Faker) buildNoParamOps() map[string]NoParamFunc {
 			return refsequence.CurrentYearCode()
 		},
 		"##fintranID##": func() string {
-			return refsequence.CurrentYearCode() + refsequence.CurrentMonthCode() + "." + f.f.UUID().V4()
+			return refsequence.CurrentYearCode() + refsequence.CurrentMonthCode() + "." + f.uuid()
 		},
 		"##orderID##": func() string {
-			return refsequence.CurrentYearCode() + refsequence.CurrentMonthCode() + "." + f.f.UUID().V4()
+			return refsequence.CurrentYearCode() + refsequence.CurrentMonthCode() + "." + f.uuid()
 		},
 		"##side##": func() string {
-			return randomSide()
+			return f.randomSide()
 		},
 		"##symbol##": func() string {
-			s := f.instruments.RandomSymbol()
+			s := f.instruments.RandomSymbol(f.rnd)
 			if s == nil {
 				return ""
 			}
 			return *s
 		},
 		"##instrumentID##": func() string {
-			s := f.instruments.RandomID()
+			s := f.instruments.RandomID(f.rnd)
 			if s == nil {
 				return ""
 			}
@@ -1,4 +1,4 @@
-package main
+package pqlquery
 
 import (
 	"context"
@@ -7,19 +7,15 @@ import (
 	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/smithy-go"
 	"io/ioutil"
 	"log"
 	"os"
-	"pql/creds"
+	"pql/cli"
 	"pql/ddb"
-	"pql/util"
-	"pql/version"
+	"pql/metrics"
 	"strings"
 	"sync/atomic"
 	"text/template"
@@ -27,16 +23,11 @@ import (
 )
 
 const (
-	AWS_KEY_ENV    = "AWS_ACCESS_KEY_ID"
-	AWS_SECRET_ENV = "AWS_SECRET_ACCESS_KEY"
-	AWS_REGION_ENV = "AWS_REGION"
-
 	DEFAULT_MAX_ROWS = -1
 )
 
 var (
 	maxRetries   int
-	profile      string
 	query        string
 	consistent   bool
 	minify       bool
@@ -45,61 +36,50 @@ var (
 	maxRows      int32
 	templateName string
 	tmplt        *template.Template
+	metricsAddr  string
+	mr           int
 
-	dbAwsKeyId     string
-	dbAwsSecretKey string
-	dbAwsRegion    string
+	conn cli.Connection
 
 	rowsRetrieved = new(int32)
-	retries       = new(int32)
+	totalRetries  = new(int32)
 	capUsed       = new(int64)
 
+	pageLatency *metrics.Histogram
+
 	dbClient *dynamodb.Client
 
 	ONE       = int32(1)
 	MINUS_ONE = int32(-1)
-)
 
-func init() {
-
-	flag.StringVar(&profile, "profile", "", "The optional AWS shared config credential profile name")
-	flag.StringVar(&query, "query", "", "The PartiSQL statement to execute")
-	flag.StringVar(&templateName, "template", "", "The name of a query template file to generate pql statements with, or just the content")
-	flag.BoolVar(&consistent, "consistent", false, "Specify for consistent reads")
-	flag.BoolVar(&minify, "minify", false, "Specify for minified JSON instead of DynamoDB JSON")
-	flag.BoolVar(&nout, "nout", false, "Specify to suppress completion message")
-	flag.BoolVar(&count, "count", false, "Specify to retrieve count of matching rows only")
-	flag.IntVar(&maxRetries, "maxretries", -1, "The maximum number of retries for a capacity failure (-1 for infinite)")
-	mr := 0
-	flag.IntVar(&mr, "maxrows", DEFAULT_MAX_ROWS, "The maximum number of rows to retrieve (-1 for infinite)")
-
-	usage := flag.Usage
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "pqlquery: v%s\n", version.VERSION)
-		usage()
+	// Command is the "pql query" command, which was the pqlquery tool
+	Command = &cli.Command{
+		Name:    "query",
+		Summary: "Execute a PartiQL SELECT statement and print the items as JSON, or through a template",
+		Define:  define,
+		Run:     run,
 	}
-	flag.Parse()
+)
+
+func define(fs *flag.FlagSet) {
+	conn.Flags(fs)
+	fs.StringVar(&query, "query", "", "The PartiSQL statement to execute")
+	fs.StringVar(&templateName, "template", "", "The name of a query template file to generate pql statements with, or just the content")
+	fs.BoolVar(&consistent, "consistent", false, "Specify for consistent reads")
+	fs.BoolVar(&minify, "minify", false, "Specify for minified JSON instead of DynamoDB JSON")
+	fs.BoolVar(&nout, "nout", false, "Specify to suppress completion message")
+	fs.BoolVar(&count, "count", false, "Specify to retrieve count of matching rows only")
+	fs.IntVar(&maxRetries, "maxretries", -1, "The maximum number of retries for a capacity failure (-1 for infinite)")
+	fs.StringVar(&metricsAddr, "metrics", "", "The optional address to serve Prometheus metrics on (e.g. :9102)")
+	fs.IntVar(&mr, "maxrows", DEFAULT_MAX_ROWS, "The maximum number of rows to retrieve (-1 for infinite)")
+}
+
+func run(fs *flag.FlagSet) {
 	maxRows = int32(mr)
 	if query == "" {
 		fmt.Fprintf(os.Stderr, "ERROR: No query specified\n")
 		os.Exit(-9)
 	}
-
-	if profile != "" {
-		pcfg, err := creds.GetProfileCreds(profile)
-		if err != nil {
-			fmt.Printf("ERROR: Failed to load credentials for profile [%s]: %s\n", profile, err.Error())
-			os.Exit(-10)
-		}
-		//fmt.Printf("Loaded Profile: source=%s\n", pcfg[0])
-		dbAwsKeyId = pcfg[1]
-		dbAwsSecretKey = pcfg[2]
-		dbAwsRegion = pcfg[3]
-	} else {
-		dbAwsKeyId = util.Env("", AWS_KEY_ENV)
-		dbAwsSecretKey = util.Env("", AWS_SECRET_ENV)
-		dbAwsRegion = util.Env("us-east-1", AWS_REGION_ENV)
-	}
 	if templateName != "" {
 		if t, err := loadTemplate(templateName); err != nil {
 			fmt.Printf("ERROR: Failed to load template: file=[%s], error=%s\n", templateName, err.Error())
@@ -108,39 +88,30 @@ func init() {
 			tmplt = t
 		}
 	}
-}
 
-func main() {
 	//fmt.Fprintf(os.Stderr, "Output: %s\n", stdOutFileName())
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(dbAwsRegion),
-		config.WithCredentialsProvider(creds.NewChainedCredentialProvider(
-			credentials.NewStaticCredentialsProvider(dbAwsKeyId, dbAwsSecretKey, ""),
-			ec2rolecreds.New(),
-		)),
-	)
-
-	if err != nil {
-		log.Fatalf("unable to load SDK config, %v", err)
-	}
-	dbClient = dynamodb.NewFromConfig(cfg)
+	dbClient = conn.Client()
+	cli.ServeMetrics(metricsAddr, registerMetrics)
 	retries := 0
 	loops := 0
 	var rowCount int32
 	var nextToken *string = nil
 	startTime := time.Now()
 	for {
-
-		if out, err := dbClient.ExecuteStatement(context.TODO(), &dynamodb.ExecuteStatementInput{
+		pageStart := time.Now()
+		out, err := dbClient.ExecuteStatement(context.TODO(), &dynamodb.ExecuteStatementInput{
 			Statement:              &query,
 			ConsistentRead:         &consistent,
 			NextToken:              nextToken,
 			Parameters:             nil,
 			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
-		}); err != nil {
+		})
+		pageLatency.ObserveSince(pageStart)
+		if err != nil {
 			if serr, ok := err.(*smithy.OperationError); ok {
 				if rerr, ok := serr.Err.(*retry.MaxAttemptsError); ok {
 					retries++
+					atomic.AddInt32(totalRetries, ONE)
 					if maxRetries != -1 && retries > maxRetries {
 						log.Fatalf("Statement Failure: error=%s\n", rerr.Error())
 					} else {
@@ -149,6 +120,7 @@ func main() {
 				}
 				if strings.Contains(serr.Error(), "quota") || strings.Contains(serr.Err.Error(), "quota") {
 					retries++
+					atomic.AddInt32(totalRetries, ONE)
 					if maxRetries != -1 && retries > maxRetries {
 						log.Fatalf("Statement Failure: error=%s\n", serr.Err.Error())
 					} else {
@@ -230,6 +202,19 @@ func main() {
 	}
 }
 
+func registerMetrics() {
+	metrics.CounterFunc("pqlquery_rows_retrieved_total", "The number of rows retrieved", func() float64 {
+		return float64(atomic.LoadInt32(rowsRetrieved))
+	})
+	metrics.CounterFunc("pqlquery_retries_total", "The number of query page retries", func() float64 {
+		return float64(atomic.LoadInt32(totalRetries))
+	})
+	metrics.CounterFunc("pqlquery_capacity_units_total", "The capacity units consumed", func() float64 {
+		return float64(atomic.LoadInt64(capUsed))
+	})
+	pageLatency = metrics.NewHistogram("pqlquery_page_latency_seconds", "The latency of ExecuteStatement calls", metrics.DefaultBuckets)
+}
+
 func stdOutFileName() string {
 	stat, _ := os.Stdout.Stat()
 	return stat.Name()
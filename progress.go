@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"pql/executor"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROGRESS_INTERVAL = 500 * time.Millisecond
+	// The period the rates and ETA are averaged over
+	PROGRESS_WINDOW = 5 * time.Second
+	// Lines are cut to fit an 80 column terminal, so they never wrap and can be redrawn in place
+	PROGRESS_WIDTH     = 79
+	PROGRESS_BAR_WIDTH = 20
+	MAX_PROGRESS_FILES = 5
+)
+
+// progressDisplay draws a progress bar, and a line for each input in process, at the bottom of the terminal.
+// Log lines are written through it, so they scroll by above the bar rather than through it.
+type progressDisplay struct {
+	lock    *sync.Mutex
+	out     *os.File
+	active  bool
+	drawn   []string // The lines currently drawn below the log output
+	samples []progressSample
+}
+
+type progressSample struct {
+	at       time.Time
+	executed int
+	retries  int
+	lines    int
+}
+
+func newProgressDisplay(out *os.File) *progressDisplay {
+	var l sync.Mutex
+	return &progressDisplay{lock: &l, out: out}
+}
+
+// Write writes log output above the progress bar
+func (p *progressDisplay) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw(p.drawn)
+	return n, err
+}
+
+// run redraws the progress of the running target until the process exits
+func (p *progressDisplay) run() {
+	for {
+		time.Sleep(PROGRESS_INTERVAL)
+		t, st := currentStats()
+		if t == nil {
+			continue
+		}
+		text := p.render(t, st, time.Now())
+		p.lock.Lock()
+		if p.active {
+			p.clear()
+			p.draw(text)
+		}
+		p.lock.Unlock()
+	}
+}
+
+// start shows the progress of the next target from scratch
+func (p *progressDisplay) start() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.active = true
+	p.samples = nil
+}
+
+// stop removes the progress bar, so the final status and summary tables can be printed
+func (p *progressDisplay) stop() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	p.active = false
+}
+
+// clear erases the drawn lines, leaving the cursor at the start of the first one. The lock must be held.
+func (p *progressDisplay) clear() {
+	if len(p.drawn) == 0 {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("\r\033[K")
+	for idx := 1; idx < len(p.drawn); idx++ {
+		b.WriteString("\033[1A\033[K")
+	}
+	p.out.WriteString(b.String())
+}
+
+// draw writes the lines, leaving the cursor at the end of the last one. The lock must be held.
+func (p *progressDisplay) draw(text []string) {
+	if !p.active || len(text) == 0 {
+		p.drawn = nil
+		return
+	}
+	p.out.WriteString(strings.Join(text, "\n"))
+	p.drawn = text
+}
+
+// render formats the progress of a target: the overall bar and rates, then a line for each input in process
+func (p *progressDisplay) render(t *target, st executor.Stats, now time.Time) []string {
+	inputs := currentProgress()
+	total, counted := inputLines()
+	done := finishedLines()
+	for _, in := range inputs {
+		done += in.Line
+	}
+	rows, throttles, lineRate := p.rates(progressSample{at: now, executed: st.Executed, retries: st.Retries, lines: done})
+
+	var b strings.Builder
+	if len(targets) > 1 {
+		b.WriteString(t.name + "  ")
+	}
+	if counted && total > 0 {
+		pct := float64(done) / float64(total)
+		if pct > 1 {
+			pct = 1
+		}
+		filled := int(pct * PROGRESS_BAR_WIDTH)
+		fmt.Fprintf(&b, "[%s%s] %5.1f%%  %d/%d lines", strings.Repeat("#", filled), strings.Repeat(".", PROGRESS_BAR_WIDTH-filled), pct*100, done, total)
+		if total > done && lineRate > 0 {
+			fmt.Fprintf(&b, "  ETA %s", (time.Duration(float64(total-done)/lineRate) * time.Second).Round(time.Second))
+		}
+	} else {
+		fmt.Fprintf(&b, "%d lines", done)
+	}
+	text := []string{
+		cut(b.String()),
+		cut(fmt.Sprintf("%.0f rows/s  %.1f throttled/s  executed=%d  failed=%d", rows, throttles, st.Executed, st.Failed)),
+	}
+
+	for idx, in := range inputs {
+		if idx == MAX_PROGRESS_FILES {
+			text = append(text, fmt.Sprintf("  ... %d more inputs", len(inputs)-idx))
+			break
+		}
+		line := fmt.Sprintf("  %s  line %d", filepath.Base(in.Name), in.Line)
+		if n, ok := fileLineCount(in.Name); ok && n > 0 {
+			line = fmt.Sprintf("  %s  line %d/%d  %.0f%%", filepath.Base(in.Name), in.Line, n, 100*float64(in.Line)/float64(n))
+		}
+		line += fmt.Sprintf("  executed=%d", in.Executed)
+		if in.Failed > 0 {
+			line += fmt.Sprintf("  failed=%d", in.Failed)
+		}
+		text = append(text, cut(line))
+	}
+	return text
+}
+
+// rates returns the rows executed, the retries and the lines read per second over the PROGRESS_WINDOW
+func (p *progressDisplay) rates(s progressSample) (float64, float64, float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.samples = append(p.samples, s)
+	for len(p.samples) > 2 && s.at.Sub(p.samples[0].at) > PROGRESS_WINDOW {
+		p.samples = p.samples[1:]
+	}
+	first := p.samples[0]
+	secs := s.at.Sub(first.at).Seconds()
+	if secs <= 0 {
+		return 0, 0, 0
+	}
+	return float64(s.executed-first.executed) / secs, float64(s.retries-first.retries) / secs, float64(s.lines-first.lines) / secs
+}
+
+// cut shortens a line to the PROGRESS_WIDTH
+func cut(s string) string {
+	r := []rune(s)
+	if len(r) > PROGRESS_WIDTH {
+		return string(r[:PROGRESS_WIDTH])
+	}
+	return s
+}
+
+// inputLines returns the total lines of the inputs, and whether every input has been counted
+func inputLines() (int, bool) {
+	linesLock.Lock()
+	defer linesLock.Unlock()
+	return int(atomic.LoadInt64(totalLines)), len(fileLines) == len(inFiles)
+}
+
+// fileLineCount returns the lines of an input, if it has been counted
+func fileLineCount(name string) (int, bool) {
+	linesLock.Lock()
+	defer linesLock.Unlock()
+	n, ok := fileLines[name]
+	return n, ok
+}
+
+// finishedLines returns the lines of the inputs the running target has finished
+func finishedLines() int {
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	lines := 0
+	for _, r := range fileResults {
+		if r.StoppedLine > 0 {
+			lines += r.StoppedLine
+		} else if n, ok := fileLineCount(r.Name); ok {
+			lines += n
+		}
+	}
+	return lines
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"pql/executor"
+	"pql/guard"
+	"pql/statement"
+	"sort"
+	"strings"
+)
+
+// confirmTargets has the DELETE and UPDATE statements in the input confirmed for each protected target,
+// exiting if any are not confirmed
+func confirmTargets() {
+	g := guard.FromEnv("pql", override)
+	protected := false
+	for idx := range targets {
+		protected = protected || g.IsProtected(guardTarget(&targets[idx]))
+	}
+	if !protected && !g.HasProtectedTables() {
+		return
+	}
+	ops := destructiveOps(inFiles, g, protected)
+	for idx := range targets {
+		if err := g.Confirm(guardTarget(&targets[idx]), ops); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+			os.Exit(-9)
+		}
+	}
+}
+
+func guardTarget(t *target) guard.Target {
+	return guard.Target{Name: t.name, Profile: t.profile, Region: t.region}
+}
+
+// destructiveOps counts the DELETE and UPDATE statements in the input for each table. Stdin and named pipes
+// can only be read once, so they could delete or update any table. Unless a target is protected, only the
+// protected tables are counted, and when they are all named without wildcards the scan stops once each has
+// a DELETE and an UPDATE, leaving the counts out.
+func destructiveOps(names []string, g *guard.Guard, allTables bool) []guard.Operation {
+	counts := make(map[guard.Operation]int)
+	remaining := make(map[guard.Operation]bool)
+	if !allTables {
+		for _, table := range g.TableNames() {
+			remaining[guard.Operation{Op: statement.OP_DELETE, Table: strings.ToLower(table)}] = true
+			remaining[guard.Operation{Op: statement.OP_UPDATE, Table: strings.ToLower(table)}] = true
+		}
+	}
+	stopEarly := len(remaining) > 0
+	count := func(text string) bool {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			return true
+		}
+		// A statement that cannot be parsed counts against unknown tables
+		k := guard.Operation{Op: strings.ToUpper(fields[0])}
+		if k.Op != statement.OP_DELETE && k.Op != statement.OP_UPDATE {
+			return true
+		}
+		if p, err := statement.Parse(text); err == nil {
+			k = guard.Operation{Op: p.Op, Table: p.TableName()}
+		}
+		if k.Table != "" && !allTables && !g.IsTableProtected(k.Table) {
+			return true
+		}
+		counts[k]++
+		delete(remaining, guard.Operation{Op: k.Op, Table: strings.ToLower(k.Table)})
+		return !stopEarly || len(remaining) > 0
+	}
+	stopped := false
+	if paramStatement != "" {
+		// The statement is executed once per data row, which are not counted
+		count(paramStatement)
+	} else {
+		for _, name := range names {
+			if info, err := os.Stat(name); name == executor.STDIN_NAME || err != nil || !info.Mode().IsRegular() {
+				counts[guard.Operation{Op: statement.OP_DELETE}]++
+				counts[guard.Operation{Op: statement.OP_UPDATE}]++
+				continue
+			}
+			if stopped = !countFile(name, count); stopped {
+				break
+			}
+		}
+	}
+	ops := make([]guard.Operation, 0, len(counts))
+	for k, n := range counts {
+		if k.Table != "" && paramStatement == "" && !stopped {
+			k.Statements = n
+		}
+		ops = append(ops, k)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Table != ops[j].Table {
+			return ops[i].Table < ops[j].Table
+		}
+		return ops[i].Op < ops[j].Op
+	})
+	return ops
+}
+
+// countFile passes each statement in an input file to count, until count returns false, returning false
+// if it stopped early. A file that cannot be read is left for execution to report.
+func countFile(name string, count func(string) bool) bool {
+	file, err := executor.OpenInput(name)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+	scanner := statement.NewScanner(file)
+	for scanner.Scan() {
+		if st := scanner.Statement(); st.Kind == statement.KindStatement && !count(st.Text) {
+			return false
+		}
+	}
+	return true
+}
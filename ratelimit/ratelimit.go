@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// The fraction of the current rate retained when throttling is signalled
+	DECREASE_FACTOR = 0.5
+	// The fraction of the target rate added back for each interval without throttling
+	INCREASE_STEP = 0.05
+	// The lowest fraction of the target rate a Limiter will back off to
+	MIN_FRACTION = 0.05
+	// The minimum time between two rate adjustments
+	ADJUST_INTERVAL = time.Second
+
+	BACKOFF_BASE = 50 * time.Millisecond
+	BACKOFF_MAX  = 10 * time.Second
+)
+
+// Limiter is a token bucket enforcing a target rate of units (statements, capacity units) per second.
+// The enforced rate adapts to throttling with AIMD: it is halved when throttling is signalled and
+// climbs back towards the target in small steps while requests succeed.
+type Limiter struct {
+	lock       *sync.Mutex
+	target     float64
+	rate       float64
+	min        float64
+	tokens     float64
+	last       time.Time
+	lastAdjust time.Time
+}
+
+func NewLimiter(target float64) *Limiter {
+	var l sync.Mutex
+	now := time.Now()
+	// Adjustable from the start, so throttling in the first second of a run backs off straight away
+	return &Limiter{
+		lock:       &l,
+		target:     target,
+		rate:       target,
+		min:        math.Max(target*MIN_FRACTION, 1),
+		tokens:     target,
+		last:       now,
+		lastAdjust: now.Add(-ADJUST_INTERVAL),
+	}
+}
+
+// Wait blocks until n units can be consumed at the current rate, or the context is done.
+// Units are reserved immediately, so concurrent callers queue up behind each other. A nil Limiter never blocks.
+func (l *Limiter) Wait(ctx context.Context, n float64) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	l.refill(time.Now())
+	l.tokens -= n
+	if l.tokens >= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.lock.Unlock()
+	return Sleep(ctx, wait)
+}
+
+// Adjust charges (or refunds, when negative) units once the actual cost of a request is known
+func (l *Limiter) Adjust(n float64) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.tokens -= n
+}
+
+// Throttled signals a throttling response, multiplicatively decreasing the rate
+func (l *Limiter) Throttled() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastAdjust) < ADJUST_INTERVAL {
+		// Concurrent requests throttled by the same burst count once
+		return
+	}
+	l.refill(now)
+	l.rate = math.Max(l.min, l.rate*DECREASE_FACTOR)
+	l.lastAdjust = now
+}
+
+// Succeeded signals a request that was not throttled, additively increasing the rate towards the target
+func (l *Limiter) Succeeded() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if l.rate >= l.target || now.Sub(l.lastAdjust) < ADJUST_INTERVAL {
+		return
+	}
+	l.refill(now)
+	l.rate = math.Min(l.target, l.rate+l.target*INCREASE_STEP)
+	l.lastAdjust = now
+}
+
+// Rate returns the currently enforced rate in units per second
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// refill adds the tokens accrued since the last call, holding at most one second's worth
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	l.tokens = math.Min(l.rate, l.tokens+elapsed*l.rate)
+}
+
+// Backoff returns the delay before retry number attempt (1 based): a random duration between zero and
+// an exponentially growing ceiling ("full jitter"), so throttled callers do not retry in lock step
+func Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	ceiling := BACKOFF_MAX
+	if attempt < 32 {
+		if c := BACKOFF_BASE << uint(attempt-1); c > 0 && c < BACKOFF_MAX {
+			ceiling = c
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// Sleep waits for the passed duration or until the context is done, returning the context's error in the latter case
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffCapsUnderJitter(t *testing.T) {
+	// Shifting the base by the attempt overflows long before the attempt count does, the ceiling must still hold
+	for _, attempt := range []int{-1, 0, 8, 9, 30, 31, 32, 33, 63, 64, 1 << 20, math.MaxInt32} {
+		for i := 0; i < 200; i++ {
+			if d := Backoff(attempt); d <= 0 || d > BACKOFF_MAX {
+				t.Fatalf("Backoff(%d) = %s, want (0, %s]", attempt, d, BACKOFF_MAX)
+			}
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if d := Backoff(0); d > BACKOFF_BASE {
+			t.Fatalf("Backoff(0) = %s, want at most the first attempt's %s", d, BACKOFF_BASE)
+		}
+	}
+}
+
+func TestBackoffSpreadsCallers(t *testing.T) {
+	// Callers throttled together must not all retry at the same moment
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 50; i++ {
+		seen[Backoff(10)] = true
+	}
+	if len(seen) < 40 {
+		t.Errorf("50 backoffs gave %d distinct delays", len(seen))
+	}
+}
+
+func TestLimiterThrottledAtStart(t *testing.T) {
+	l := NewLimiter(100)
+	l.Throttled()
+	if got := l.Rate(); got != 50 {
+		t.Errorf("Rate() after throttling in the first second = %v, want 50", got)
+	}
+	// The rest of the same burst counts once
+	l.Throttled()
+	if got := l.Rate(); got != 50 {
+		t.Errorf("Rate() after a second throttle in the interval = %v, want 50", got)
+	}
+}
+
+func TestLimiterRateBounds(t *testing.T) {
+	l := NewLimiter(4)
+	for i := 0; i < 10; i++ {
+		l.lastAdjust = l.lastAdjust.Add(-ADJUST_INTERVAL)
+		l.Throttled()
+	}
+	// 5% of 4 is below one unit per second, which would leave a caller waiting for longer than a second per unit
+	if got := l.Rate(); got != 1 {
+		t.Errorf("Rate() = %v, want the floor of 1", got)
+	}
+	for i := 0; i < 100; i++ {
+		l.lastAdjust = l.lastAdjust.Add(-ADJUST_INTERVAL)
+		l.Succeeded()
+	}
+	if got := l.Rate(); got != 4 {
+		t.Errorf("Rate() = %v, want the target of 4 and no more", got)
+	}
+}
+
+func TestLimiterBucketShrinksWithTheRate(t *testing.T) {
+	l := NewLimiter(100)
+	l.Throttled()
+	l.refill(l.last.Add(time.Minute))
+	if l.tokens != 50 {
+		t.Errorf("tokens = %v, want at most one second at the throttled rate", l.tokens)
+	}
+}
+
+func TestLimiterWaitersQueue(t *testing.T) {
+	l := NewLimiter(20)
+	l.Wait(context.Background(), 20)
+	// Each waiter reserves its units, so the second waits behind the first instead of both waking at once
+	var wg sync.WaitGroup
+	elapsed := make([]time.Duration, 2)
+	start := time.Now()
+	for idx := range elapsed {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			l.Wait(context.Background(), 2)
+			elapsed[idx] = time.Since(start)
+		}(idx)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	if elapsed[0] < 60*time.Millisecond || elapsed[1] < 160*time.Millisecond {
+		t.Errorf("waits = %v, want about 100ms and 200ms", elapsed)
+	}
+}
+
+func TestLimiterAdjustRefund(t *testing.T) {
+	l := NewLimiter(10)
+	l.Wait(context.Background(), 10)
+	// The request turned out cheaper than reserved, the refund is available straight away
+	l.Adjust(-5)
+	start := time.Now()
+	l.Wait(context.Background(), 5)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Wait() for refunded units took %s", elapsed)
+	}
+	var none *Limiter
+	none.Adjust(1)
+	none.Throttled()
+	none.Succeeded()
+	if err := none.Wait(context.Background(), 1); err != nil || none.Rate() != 0 {
+		t.Errorf("nil Limiter Wait(), Rate() = %v, %v", err, none.Rate())
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if err := Sleep(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("Sleep() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Sleep() returned %s after the cancel", elapsed)
+	}
+	// Nothing to wait for is not an error, even once the context is done
+	if err := Sleep(ctx, 0); err != nil {
+		t.Errorf("Sleep(0) on a done context = %v", err)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"log"
 	"math/rand"
+	"pql/config"
 	"pql/ddb"
 	"strings"
 	"time"
@@ -24,13 +26,14 @@ var (
 type RefSequence struct {
 	dbClient   *dynamodb.Client
 	wlpDecodes map[string]string
+	rnd        *rand.Rand
 }
 
 func loadWlps(dbClient *dynamodb.Client) (map[string]string, error) {
 	m := make(map[string]string, 256)
 	var startKey map[string]types.AttributeValue = nil
 	scanRequest := &dynamodb.ScanInput{
-		TableName:         &wlpsTable,
+		TableName:         aws.String(config.TableName(wlpsTable)),
 		AttributesToGet:   []string{"wlpID", "prefix"},
 		ExclusiveStartKey: startKey,
 	}
@@ -49,7 +52,7 @@ func loadWlps(dbClient *dynamodb.Client) (map[string]string, error) {
 					pref = prefAv.(string)
 					break
 				case int64:
-					pref = fmt.Sprintf("%02d", pref)
+					pref = fmt.Sprintf("%02d", prefAv.(int64))
 					break
 				}
 				//log.Printf("WLP: %s\n", wlp)
@@ -75,17 +78,27 @@ func NewRefSequence(dbClient *dynamodb.Client) (*RefSequence, error) {
 	}
 }
 
-func Shard(monthly bool) string {
+// WithRand returns a RefSequence sharing the loaded WLP prefixes that picks its shards from the passed source
+func (r *RefSequence) WithRand(rnd *rand.Rand) *RefSequence {
+	return &RefSequence{dbClient: r.dbClient, wlpDecodes: r.wlpDecodes, rnd: rnd}
+}
+
+// Shard picks a random sequence shard using the passed source, or the global source if it is nil
+func Shard(rnd *rand.Rand, monthly bool) string {
+	intn := rand.Intn
+	if rnd != nil {
+		intn = rnd.Intn
+	}
 	var b strings.Builder
 	if monthly {
 		dp := NewDatePart(time.Now())
 		b.WriteString(dp.YearCode())
 		b.WriteString(dp.MonthCode())
-		b.WriteRune(A2Z[rand.Intn(A2ZLast)])
-		b.WriteRune(A2Z[rand.Intn(A2ZLast)])
+		b.WriteRune(A2Z[intn(A2ZLast)])
+		b.WriteRune(A2Z[intn(A2ZLast)])
 	} else {
-		b.WriteRune(A2Z[rand.Intn(A2ZLast)])
-		b.WriteRune(A2Z[rand.Intn(A2ZLast)])
+		b.WriteRune(A2Z[intn(A2ZLast)])
+		b.WriteRune(A2Z[intn(A2ZLast)])
 		//b.WriteRune(A2Z[rand.Intn(A2ZLast)])
 		//b.WriteRune(A2Z[rand.Intn(A2ZLast)])
 	}
@@ -94,7 +107,7 @@ func Shard(monthly bool) string {
 
 func (r *RefSequence) GetRefSequences(shard string, count int) ([]string, error) {
 	arr := make([]string, count, count)
-	shardID := Shard(true)
+	shardID := Shard(r.rnd, true)
 	sequenceKey := shard + "_" + shardID
 	avUpdate := types.AttributeValueUpdate{
 		Action: "ADD",
@@ -108,7 +121,7 @@ func (r *RefSequence) GetRefSequences(shard string, count int) ([]string, error)
 	}
 	updateRequest := &dynamodb.UpdateItemInput{
 		Key:              key,
-		TableName:        &refSequenceTable,
+		TableName:        aws.String(config.TableName(refSequenceTable)),
 		AttributeUpdates: updates,
 		ReturnValues:     types.ReturnValueUpdatedNew,
 	}
@@ -135,7 +148,7 @@ func (r *RefSequence) GetRefSequencesWithWLP(shard, wlpID string, count int, mon
 		wlpPrefix = p
 	}
 	arr := make([]string, count, count)
-	shardID := Shard(monthly)
+	shardID := Shard(r.rnd, monthly)
 	sequenceKey := shard + "_" + wlpPrefix + shardID
 	avUpdate := types.AttributeValueUpdate{
 		Action: "ADD",
@@ -149,7 +162,7 @@ func (r *RefSequence) GetRefSequencesWithWLP(shard, wlpID string, count int, mon
 	}
 	updateRequest := &dynamodb.UpdateItemInput{
 		Key:              key,
-		TableName:        &refSequenceTable,
+		TableName:        aws.String(config.TableName(refSequenceTable)),
 		AttributeUpdates: updates,
 		ReturnValues:     types.ReturnValueUpdatedNew,
 	}
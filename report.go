@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"pql/audit"
+	"pql/executor"
+	"pql/util"
+	"pql/version"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runReport is the record of a run written to the -report file
+type runReport struct {
+	Version     string         `json:"version"`
+	Args        []string       `json:"args"`
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+	Elapsed     string         `json:"elapsed"`
+	Interrupted bool           `json:"interrupted"`
+	NoExec      bool           `json:"noexec"`
+	Seed        int64          `json:"seed,omitempty"`
+	Targets     []targetReport `json:"targets"`
+}
+
+type targetReport struct {
+	Name    string                `json:"name"`
+	Region  string                `json:"region"`
+	Status  string                `json:"status"`
+	Started *time.Time            `json:"started,omitempty"`
+	Elapsed string                `json:"elapsed,omitempty"`
+	Stats   *executor.Stats       `json:"stats,omitempty"`
+	Errors  map[string]int        `json:"errors,omitempty"`       // The failures by error code, across every table
+	Classes map[string]int        `json:"errorClasses,omitempty"` // The failures by class of error code
+	Tables  []executor.TableStats `json:"tables,omitempty"`
+	Inputs  []*executor.Result    `json:"inputs,omitempty"`
+}
+
+// printTables prints a table of the totals for each table and operation of a target
+func printTables(t *target, tables []executor.TableStats) {
+	if len(tables) == 0 {
+		return
+	}
+	if len(targets) > 1 {
+		log.Printf("Table Stats: target=%s\n", t.name)
+	} else {
+		log.Printf("Table Stats:\n")
+	}
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "TABLE\tOP\tEXECUTED\tFAILED\tRETRIES\tCAPACITY\tP50\tP99\tERRORS\n")
+	for _, ts := range tables {
+		table := ts.Table
+		if table == "" {
+			table = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%.1f\t%s\t%s\t%s\n", table, ts.Op, ts.Executed, ts.Failed, ts.Retries, ts.CapacityUnits,
+			formatLatency(ts.Latency.Calls, ts.Latency.P50), formatLatency(ts.Latency.Calls, ts.Latency.P99), formatErrors(ts.Errors))
+	}
+	w.Flush()
+}
+
+func formatLatency(calls int, ms float64) string {
+	if calls == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", ms)
+}
+
+// formatErrors lists error codes by descending count
+func formatErrors(errors map[string]int) string {
+	if len(errors) == 0 {
+		return "-"
+	}
+	codes := make([]string, 0, len(errors))
+	for code := range errors {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if errors[codes[i]] != errors[codes[j]] {
+			return errors[codes[i]] > errors[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	parts := make([]string, len(codes))
+	for idx, code := range codes {
+		parts[idx] = fmt.Sprintf("%s=%d", code, errors[code])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writeReport writes the JSON report of the run to the -report file. The stopLock must not be held.
+func writeReport(startTime time.Time) {
+	finished := time.Now()
+	rep := runReport{
+		Version:     version.VERSION,
+		Args:        os.Args[1:],
+		Started:     startTime,
+		Finished:    finished,
+		Elapsed:     finished.Sub(startTime).String(),
+		Interrupted: util.IsClosed(shutdown),
+		NoExec:      noExec,
+		Targets:     make([]targetReport, 0, len(targets)),
+	}
+	if enableFaker {
+		rep.Seed = seed
+	}
+	stopLock.Lock()
+	for idx := range targets {
+		t := &targets[idx]
+		tr := targetReport{Name: t.name, Region: t.region, Status: STATUS_NOT_RUN}
+		if s := summaryOf(t); s != nil {
+			started := t.started
+			stats := s.stats
+			tr.Status = s.status()
+			tr.Started = &started
+			tr.Elapsed = s.elapsed.String()
+			tr.Stats = &stats
+			tr.Tables = s.tables
+			tr.Inputs = s.results
+			for _, ts := range s.tables {
+				for code, count := range ts.Errors {
+					if tr.Errors == nil {
+						tr.Errors = make(map[string]int)
+						tr.Classes = make(map[string]int)
+					}
+					tr.Errors[code] += count
+					tr.Classes[executor.ErrorClass(code)] += count
+				}
+			}
+		}
+		rep.Targets = append(rep.Targets, tr)
+	}
+	stopLock.Unlock()
+
+	b, err := json.MarshalIndent(rep, "", "  ")
+	if err == nil {
+		err = os.WriteFile(reportName, append(b, '\n'), 0644)
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to write report: file=%s, error=%s\n", reportName, err.Error())
+		return
+	}
+	log.Printf("Report Written: file=%s\n", reportName)
+}
+
+// auditRun appends the record of the run, with the hashes of its inputs and the final counters of each
+// target, to the audit log. The stopLock must not be held.
+func auditRun(exitStatus int) {
+	if run == nil {
+		return
+	}
+	// Large inputs can take a while to hash, which must not hold up the exit
+	select {
+	case run.Inputs = <-inputHashes:
+	case <-time.After(INPUT_HASH_WAIT):
+		log.Printf("WARNING: Input hashes not recorded, still hashing: wait=%s\n", INPUT_HASH_WAIT)
+		run.Inputs = audit.PendingInputs(inFiles)
+	}
+	run.Targets = make([]audit.RunTarget, 0, len(targets))
+	stopLock.Lock()
+	for idx := range targets {
+		t := &targets[idx]
+		rt := audit.RunTarget{Name: t.name, Profile: t.profile, Region: t.region, Operator: t.operator.String(), Status: STATUS_NOT_RUN}
+		if s := summaryOf(t); s != nil {
+			started, finished := t.started, t.started.Add(s.elapsed)
+			stats := s.stats
+			rt.Status = s.status()
+			rt.Started = &started
+			rt.Finished = &finished
+			rt.Counters = &stats
+		}
+		run.Targets = append(run.Targets, rt)
+	}
+	stopLock.Unlock()
+	if err := run.Finish(exitStatus, execConn.Endpoint); err != nil {
+		log.Printf("WARNING: Failed to write audit record: file=%s, error=%s\n", audit.FileName(), err.Error())
+	}
+}
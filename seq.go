@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"pql/cli"
+	"pql/refsequence"
+)
+
+var (
+	// The "pql seq" command, which allocates reference sequences from the ref.sequences table
+	seqCommand = &cli.Command{
+		Name:    "seq",
+		Summary: "Allocate reference sequence numbers, e.g. order or account numbers, and print one per line",
+		Define:  defineSeq,
+		Run:     runSeq,
+	}
+
+	seqConn    cli.Connection
+	seqName    string
+	seqWlp     string
+	seqCount   int
+	seqMonthly bool
+)
+
+func defineSeq(fs *flag.FlagSet) {
+	seqConn.Flags(fs)
+	fs.StringVar(&seqName, "name", "orderNo", "The name of the sequence to allocate from, e.g. orderNo or accountNo")
+	fs.StringVar(&seqWlp, "wlp", "", "The optional wlpID whose prefix the sequences are allocated with")
+	fs.IntVar(&seqCount, "count", 1, "The number of sequences to allocate")
+	fs.BoolVar(&seqMonthly, "monthly", false, "Specify to allocate -wlp sequences from a shard of the current month")
+}
+
+func runSeq(fs *flag.FlagSet) {
+	if seqCount < 1 {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid -count: %d\n", seqCount)
+		os.Exit(-9)
+	}
+	rs, err := refsequence.NewRefSequence(seqConn.Client())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to load wlps: %s\n", err.Error())
+		os.Exit(-9)
+	}
+	var seqs []string
+	if seqWlp != "" {
+		seqs, err = rs.GetRefSequencesWithWLP(seqName, seqWlp, seqCount, seqMonthly)
+	} else {
+		seqs, err = rs.GetRefSequences(seqName, seqCount)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to get ref-sequences: %s\n", err.Error())
+		os.Exit(-9)
+	}
+	for _, seq := range seqs {
+		fmt.Println(seq)
+	}
+}
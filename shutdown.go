@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"pql/executor"
+	"sync"
+	"time"
+)
+
+const (
+	// The exit status of a run stopped by SIGINT or SIGTERM
+	EXIT_INTERRUPTED = 130
+	// The longest the audit record waits at exit for the input files to finish hashing
+	INPUT_HASH_WAIT = 5 * time.Second
+)
+
+var (
+	stopLock      sync.Mutex
+	stopPositions []string
+	fileResults   []*executor.Result
+	summaries     []targetSummary
+	finishOnce    sync.Once
+	startTime     time.Time
+
+	// Guards the running target and its executor and output files
+	targetLock sync.Mutex
+	current    *target
+)
+
+// recordStop notes where reading an input stopped on shutdown, for the final summary
+func recordStop(fileName string, line int) {
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	stopPositions = append(stopPositions, fmt.Sprintf("file=%s, line=%d", fileName, line))
+}
+
+// recordResult keeps the result of an input for the -report file
+func recordResult(result *executor.Result) {
+	if result == nil {
+		return
+	}
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	fileResults = append(fileResults, result)
+}
+
+// closeTarget flushes and closes the output files of the running target and prints its final status, once
+func closeTarget() {
+	targetLock.Lock()
+	t, x, d, j, u := current, exec, deadLetter, journal, undo
+	progress.stop()
+	if t == nil {
+		targetLock.Unlock()
+		return
+	}
+	st := x.Stats()
+	tables := x.TableStats()
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	stopped := stopPositions
+	stopPositions = nil
+	summaries = append(summaries, targetSummary{
+		target:  t,
+		stats:   st,
+		tables:  tables,
+		results: fileResults,
+		elapsed: time.Since(t.started),
+		stopped: len(stopped) > 0,
+	})
+	fileResults = nil
+	current = nil
+	targetLock.Unlock()
+
+	d.Close()
+	j.Close()
+	u.Close()
+	printStats(t, st, true)
+	if !noExec {
+		printTables(t, tables)
+	}
+	for _, pos := range stopped {
+		log.Printf("Input Stopped: %s\n", pos)
+	}
+	if len(stopped) > 0 && j != nil {
+		log.Printf("Resume with: -journal %s -resume\n", journalName)
+	}
+}
+
+// currentStats returns the totals of the running target, if there is one
+func currentStats() (*target, executor.Stats) {
+	targetLock.Lock()
+	defer targetLock.Unlock()
+	if current == nil {
+		return nil, executor.Stats{}
+	}
+	return current, exec.Stats()
+}
+
+// currentProgress returns the progress of the inputs of the running target
+func currentProgress() []executor.Progress {
+	targetLock.Lock()
+	defer targetLock.Unlock()
+	if current == nil {
+		return nil
+	}
+	return exec.Progress()
+}
+
+// totalStats returns the totals across every target run so far, for the metrics counters, which must
+// not go down when the next target starts
+func totalStats() executor.Stats {
+	targetLock.Lock()
+	defer targetLock.Unlock()
+	var st executor.Stats
+	if current != nil {
+		st = exec.Stats()
+	}
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	for _, s := range summaries {
+		st.Executed += s.stats.Executed
+		st.Failed += s.stats.Failed
+		st.Batches += s.stats.Batches
+		st.BatchesFailed += s.stats.BatchesFailed
+		st.Retries += s.stats.Retries
+		st.CapacityUnits += s.stats.CapacityUnits
+	}
+	return st
+}
+
+// exitFailed reports the error a run cannot carry on from, and exits with the passed status, once the run
+// is finished and recorded in the audit log if it was started
+func exitFailed(exitStatus int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "ERROR: %s\n", message)
+	if run != nil {
+		run.Error = message
+		finish(startTime, exitStatus)
+	}
+	os.Exit(exitStatus)
+}
+
+// finish closes the running target, prints the final summary and records the run in the audit log, once
+func finish(startTime time.Time, exitStatus int) {
+	finishOnce.Do(func() {
+		closeTarget()
+		if len(targets) > 1 {
+			stopLock.Lock()
+			printSummary()
+			stopLock.Unlock()
+		}
+		if reportName != "" {
+			writeReport(startTime)
+		}
+		auditRun(exitStatus)
+		log.Printf("Done. Elapsed=%s\n", time.Since(startTime))
+	})
+}
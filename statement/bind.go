@@ -0,0 +1,100 @@
+package statement
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Placeholders returns the number of '?' parameter placeholders in a statement, ignoring any inside quotes
+func Placeholders(text string) int {
+	count := 0
+	forEachPlaceholder(text, func(int) {
+		count++
+	})
+	return count
+}
+
+// Bind replaces each '?' placeholder in a statement with the literal at the same position,
+// producing a statement that can be executed without parameters
+func Bind(text string, literals []string) (string, error) {
+	if n := Placeholders(text); n != len(literals) {
+		return "", errors.New(fmt.Sprintf("Statement has %d placeholders but %d values were supplied", n, len(literals)))
+	}
+	var b strings.Builder
+	last := 0
+	idx := 0
+	forEachPlaceholder(text, func(pos int) {
+		b.WriteString(text[last:pos])
+		b.WriteString(literals[idx])
+		last = pos + 1
+		idx++
+	})
+	b.WriteString(text[last:])
+	return b.String(), nil
+}
+
+// Binaries replaces each BINARY '<base64>' literal in a statement with a '?' placeholder, returning the
+// statement and the decoded values keyed by the position of their placeholder (0 based). PartiQL has no
+// binary literal, so the values are passed to DynamoDB as parameters.
+func Binaries(text string) (string, map[int][]byte, error) {
+	if !strings.Contains(strings.ToUpper(text), "BINARY") {
+		return text, nil, nil
+	}
+	tokens, _, err := tokenize(text)
+	if err != nil {
+		// The statement fails on its own
+		return text, nil, nil
+	}
+	var b strings.Builder
+	values := make(map[int][]byte)
+	last := 0
+	params := 0
+	for idx := 0; idx < len(tokens); idx++ {
+		t := tokens[idx]
+		if t.kind == tkParam {
+			params++
+			continue
+		}
+		if !t.is("BINARY") || idx+1 == len(tokens) || tokens[idx+1].kind != tkString {
+			continue
+		}
+		literal := tokens[idx+1]
+		_, encoded, _ := scanQuoted(text, literal.pos)
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return text, nil, errors.New(fmt.Sprintf("Invalid BINARY literal at position %d: %s", t.pos, err.Error()))
+		}
+		b.WriteString(text[last:t.pos])
+		b.WriteString("?")
+		last = literal.pos + tokenLength(text, literal)
+		values[params] = value
+		params++
+		idx++
+	}
+	if len(values) == 0 {
+		return text, nil, nil
+	}
+	b.WriteString(text[last:])
+	return b.String(), values, nil
+}
+
+// forEachPlaceholder calls fx with the byte offset of each '?' outside of quoted strings and identifiers
+func forEachPlaceholder(text string, fx func(int)) {
+	inSingle, inDouble := false, false
+	for pos, c := range text {
+		switch {
+		case inSingle:
+			inSingle = c != '\''
+		case inDouble:
+			inDouble = c != '"'
+		case c == '\'':
+			inSingle = true
+		case c == '"':
+			inDouble = true
+		case c == '?':
+			fx(pos)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package statement
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	OP_INSERT = "INSERT"
+	OP_UPDATE = "UPDATE"
+	OP_DELETE = "DELETE"
+	OP_SELECT = "SELECT"
+	OP_EXISTS = "EXISTS"
+)
+
+// Value is an operand as written in a statement: either a literal or a '?' placeholder
+type Value struct {
+	Text  string // The value as it appears in the statement, e.g. 'abc', 12 or ?
+	Param int    // The ordinal of the placeholder (1 based), or 0 for a literal
+}
+
+// IsString returns true if the value is a quoted string literal
+func (v Value) IsString() bool {
+	return len(v.Text) >= 2 && v.Text[0] == '\'' && v.Text[len(v.Text)-1] == '\''
+}
+
+// String returns the unquoted text of a string literal, or the value text otherwise
+func (v Value) String() string {
+	if v.IsString() {
+		return strings.ReplaceAll(v.Text[1:len(v.Text)-1], "''", "'")
+	}
+	return v.Text
+}
+
+// Attribute is a named value, e.g. an attribute of an INSERT document, a SET assignment or a WHERE equality
+type Attribute struct {
+	Name  string
+	Value Value
+}
+
+// Parsed is the outline of a PartiQL statement: enough to tell what it does and to which item, without
+// interpreting expressions
+type Parsed struct {
+	Op       string
+	Table    string
+	Index    string // The index of a SELECT, or the remainder of an unquoted dotted table name
+	Quoted   bool   // True if the table name was double quoted
+	Where    []Attribute
+	Document []Attribute
+	Set      []Attribute
+	Remove   []string
+	Params   int
+}
+
+// ParseError is a statement syntax problem. Line is the offset from the statement's first line.
+type ParseError struct {
+	Line    int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return e.Message
+}
+
+// Key returns the values that a statement gives the passed key attributes, from the WHERE clause of an
+// UPDATE, DELETE or SELECT or the document of an INSERT. The bool is false if any key attribute is missing.
+func (p *Parsed) Key(names ...string) ([]Value, bool) {
+	attrs := p.Where
+	if p.Op == OP_INSERT {
+		attrs = p.Document
+	}
+	values := make([]Value, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, a := range attrs {
+			if a.Name == name {
+				values = append(values, a.Value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return values, false
+		}
+	}
+	return values, true
+}
+
+// TableName returns the table name as written, joining an unquoted dotted name
+func (p *Parsed) TableName() string {
+	if !p.Quoted && p.Index != "" {
+		return p.Table + "." + p.Index
+	}
+	return p.Table
+}
+
+type tokenKind int
+
+const (
+	tkWord tokenKind = iota
+	tkQuoted
+	tkString
+	tkNumber
+	tkParam
+	tkFaker
+	tkPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) is(words ...string) bool {
+	if t.kind != tkWord {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t token) isPunct(p string) bool {
+	return t.kind == tkPunct && t.text == p
+}
+
+// opens returns true for a bracket, brace, parenthesis or bag (<<) opening
+func (t token) opens() bool {
+	return t.kind == tkPunct && (t.text == "(" || t.text == "[" || t.text == "{" || t.text == "<<")
+}
+
+// closes returns true for a bracket, brace, parenthesis or bag (>>) closing
+func (t token) closes() bool {
+	return t.kind == tkPunct && (t.text == ")" || t.text == "]" || t.text == "}" || t.text == ">>")
+}
+
+// Parse outlines a single PartiQL statement, as returned by a Scanner
+func Parse(text string) (*Parsed, error) {
+	tokens, params, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty statement")
+	}
+	p := &Parsed{Op: strings.ToUpper(tokens[0].text), Params: params}
+	rest := tokens[1:]
+	switch {
+	case tokens[0].is(OP_INSERT):
+		if len(rest) == 0 || !rest[0].is("INTO") {
+			return nil, parseError(text, tokens[0].pos, "Expected INTO after INSERT")
+		}
+		if rest, err = p.parseTable(text, rest[1:]); err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 || !rest[0].is("VALUE") {
+			return nil, parseError(text, len(text), "Expected VALUE after the INSERT table name")
+		}
+		if p.Document, err = parseDocument(text, rest[1:]); err != nil {
+			return nil, err
+		}
+	case tokens[0].is(OP_UPDATE):
+		if rest, err = p.parseTable(text, rest); err != nil {
+			return nil, err
+		}
+		if rest, err = p.parseUpdate(text, rest); err != nil {
+			return nil, err
+		}
+		if len(p.Set) == 0 && len(p.Remove) == 0 {
+			return nil, parseError(text, tokens[0].pos, "UPDATE has no SET or REMOVE clause")
+		}
+		p.Where = parseWhere(text, rest)
+	case tokens[0].is(OP_DELETE):
+		if len(rest) == 0 || !rest[0].is("FROM") {
+			return nil, parseError(text, tokens[0].pos, "Expected FROM after DELETE")
+		}
+		if rest, err = p.parseTable(text, rest[1:]); err != nil {
+			return nil, err
+		}
+		p.Where = parseWhere(text, rest)
+	case tokens[0].is(OP_SELECT, OP_EXISTS):
+		from := -1
+		depth := 0
+		for idx, t := range rest {
+			switch {
+			case t.opens():
+				depth++
+			case t.closes():
+				depth--
+			case t.is("FROM") && (depth == 0 || p.Op == OP_EXISTS):
+				from = idx
+			}
+			if from != -1 {
+				break
+			}
+		}
+		if from == -1 {
+			return nil, parseError(text, tokens[0].pos, fmt.Sprintf("Expected FROM in %s", p.Op))
+		}
+		if rest, err = p.parseTable(text, rest[from+1:]); err != nil {
+			return nil, err
+		}
+		p.Where = parseWhere(text, rest)
+	default:
+		return nil, parseError(text, tokens[0].pos, fmt.Sprintf("Unsupported statement type: %s", tokens[0].text))
+	}
+	return p, nil
+}
+
+func (p *Parsed) parseTable(text string, tokens []token) ([]token, error) {
+	if len(tokens) == 0 || (tokens[0].kind != tkWord && tokens[0].kind != tkQuoted) {
+		return nil, parseError(text, len(text), "Expected a table name")
+	}
+	p.Table = tokens[0].text
+	p.Quoted = tokens[0].kind == tkQuoted
+	tokens = tokens[1:]
+	if len(tokens) > 1 && tokens[0].isPunct(".") && (tokens[1].kind == tkWord || tokens[1].kind == tkQuoted) {
+		p.Index = tokens[1].text
+		tokens = tokens[2:]
+	}
+	return tokens, nil
+}
+
+// parseUpdate reads the SET and REMOVE clauses of an UPDATE, returning the tokens after them
+func (p *Parsed) parseUpdate(text string, tokens []token) ([]token, error) {
+	clause := ""
+	for len(tokens) > 0 {
+		t := tokens[0]
+		switch {
+		case t.is("SET", "REMOVE"):
+			clause = strings.ToUpper(t.text)
+			tokens = tokens[1:]
+			continue
+		case t.is("WHERE", "RETURNING"):
+			return tokens, nil
+		case t.isPunct(","):
+			tokens = tokens[1:]
+			continue
+		case clause == "":
+			return nil, parseError(text, t.pos, fmt.Sprintf("Expected SET or REMOVE but found %s", t.text))
+		}
+		end := 0
+		depth := 0
+		eq := -1
+		for ; end < len(tokens); end++ {
+			tt := tokens[end]
+			if depth == 0 && (tt.isPunct(",") || tt.is("SET", "REMOVE", "WHERE", "RETURNING")) {
+				break
+			}
+			switch {
+			case tt.opens():
+				depth++
+			case tt.closes():
+				depth--
+			case tt.isPunct("=") && depth == 0 && eq == -1:
+				eq = end
+			}
+		}
+		item := tokens[:end]
+		tokens = tokens[end:]
+		if clause == "REMOVE" {
+			p.Remove = append(p.Remove, span(text, item))
+			continue
+		}
+		if eq < 1 || eq == len(item)-1 {
+			return nil, parseError(text, item[0].pos, "Expected path = value in SET")
+		}
+		p.Set = append(p.Set, Attribute{Name: pathName(span(text, item[:eq])), Value: toValue(text, item[eq+1:])})
+	}
+	return tokens, nil
+}
+
+// parseDocument reads the top level attributes of an INSERT VALUE document
+func parseDocument(text string, tokens []token) ([]Attribute, error) {
+	if len(tokens) == 0 || !tokens[0].isPunct("{") {
+		return nil, parseError(text, len(text), "Expected a { document } after VALUE")
+	}
+	attrs := make([]Attribute, 0, 8)
+	idx := 1
+	for idx < len(tokens) {
+		if tokens[idx].isPunct("}") {
+			return attrs, nil
+		}
+		if tokens[idx].isPunct(",") {
+			idx++
+			continue
+		}
+		name := tokens[idx]
+		if name.kind != tkString && name.kind != tkQuoted && name.kind != tkFaker {
+			return nil, parseError(text, name.pos, fmt.Sprintf("Expected a quoted attribute name in the document but found %s", name.text))
+		}
+		if idx+1 >= len(tokens) || !tokens[idx+1].isPunct(":") {
+			return nil, parseError(text, name.pos, fmt.Sprintf("Expected : after the document attribute %s", name.text))
+		}
+		start := idx + 2
+		end := start
+		depth := 0
+		for ; end < len(tokens); end++ {
+			tt := tokens[end]
+			if depth == 0 && (tt.isPunct(",") || tt.isPunct("}")) {
+				break
+			}
+			switch {
+			case tt.opens():
+				depth++
+			case tt.closes():
+				depth--
+			}
+		}
+		if end == start {
+			return nil, parseError(text, name.pos, fmt.Sprintf("Missing value for the document attribute %s", name.text))
+		}
+		attrs = append(attrs, Attribute{Name: Value{Text: name.text}.String(), Value: toValue(text, tokens[start:end])})
+		idx = end
+	}
+	return nil, parseError(text, len(text), "Unterminated document")
+}
+
+// parseWhere returns the attribute = value equalities ANDed together in a WHERE clause. An equality can
+// only be relied on if it holds for every matching item, so an OR at the level of the equality, or a NOT
+// applied to it, discards it, while an OR or NOT within another condition (e.g. x IS NOT MISSING) does not.
+func parseWhere(text string, tokens []token) []Attribute {
+	if len(tokens) == 0 || !tokens[0].is("WHERE") {
+		return nil
+	}
+	tokens = tokens[1:]
+	depth := 0
+	for idx, t := range tokens {
+		if t.opens() {
+			depth++
+		} else if t.closes() {
+			depth--
+		} else if t.is("RETURNING") && depth == 0 {
+			tokens = tokens[:idx]
+			break
+		}
+	}
+	return equalities(text, tokens, make([]Attribute, 0, 2))
+}
+
+// equalities appends the equalities of a condition, splitting it on its top level ANDs and descending
+// into the parenthesized conditions
+func equalities(text string, tokens []token, attrs []Attribute) []Attribute {
+	terms := make([][]token, 0, 4)
+	start := 0
+	depth := 0
+	for idx, t := range tokens {
+		switch {
+		case t.opens():
+			depth++
+		case t.closes():
+			depth--
+		case depth > 0:
+		case t.is("OR"):
+			// The condition holds for items matching either side, so none of its equalities is certain
+			return attrs
+		case t.is("AND"):
+			terms = append(terms, tokens[start:idx])
+			start = idx + 1
+		}
+	}
+	terms = append(terms, tokens[start:])
+	for _, term := range terms {
+		switch {
+		case len(term) > 2 && term[0].isPunct("(") && closer(term) == len(term)-1:
+			attrs = equalities(text, term[1:len(term)-1], attrs)
+		case len(term) == 3 && term[1].isPunct("=") && isPath(term[0]) && isOperand(term[2]):
+			attrs = append(attrs, Attribute{Name: term[0].text, Value: toValue(text, term[2:])})
+		case len(term) == 3 && term[1].isPunct("=") && isPath(term[2]) && isOperand(term[0]):
+			attrs = append(attrs, Attribute{Name: term[2].text, Value: toValue(text, term[:1])})
+		}
+	}
+	return attrs
+}
+
+// closer returns the index of the token closing the one the tokens open with
+func closer(tokens []token) int {
+	depth := 0
+	for idx, t := range tokens {
+		switch {
+		case t.opens():
+			depth++
+		case t.closes():
+			depth--
+			if depth == 0 {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+func isPath(t token) bool {
+	return (t.kind == tkWord && !t.is("TRUE", "FALSE", "NULL", "MISSING")) || t.kind == tkQuoted
+}
+
+func isOperand(t token) bool {
+	return t.kind == tkString || t.kind == tkNumber || t.kind == tkParam || t.kind == tkFaker
+}
+
+func toValue(text string, tokens []token) Value {
+	v := Value{Text: span(text, tokens)}
+	if len(tokens) == 1 && tokens[0].kind == tkParam {
+		fmt.Sscanf(tokens[0].text, "?%d", &v.Param)
+	}
+	return v
+}
+
+// pathName returns a SET path with any double quotes around its first element removed
+func pathName(path string) string {
+	if strings.HasPrefix(path, "\"") {
+		if end := strings.Index(path[1:], "\""); end != -1 {
+			return path[1:end+1] + path[end+2:]
+		}
+	}
+	return path
+}
+
+// span returns the statement text covered by the passed tokens
+func span(text string, tokens []token) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	last := tokens[len(tokens)-1]
+	end := last.pos + tokenLength(text, last)
+	return strings.TrimSpace(text[tokens[0].pos:end])
+}
+
+func tokenLength(text string, t token) int {
+	switch t.kind {
+	case tkString, tkQuoted:
+		// The token text is unescaped, so measure the literal in the statement
+		quote := text[t.pos]
+		for idx := t.pos + 1; idx < len(text); idx++ {
+			if text[idx] == quote {
+				if idx+1 < len(text) && text[idx+1] == quote {
+					idx++
+					continue
+				}
+				return idx + 1 - t.pos
+			}
+		}
+		return len(text) - t.pos
+	case tkParam:
+		return 1
+	}
+	return len(t.text)
+}
+
+// tokenize splits a statement into tokens, numbering the '?' placeholders in order
+func tokenize(text string) ([]token, int, error) {
+	tokens := make([]token, 0, 32)
+	params := 0
+	stack := make([]int, 0, 4)
+	pos := 0
+	for pos < len(text) {
+		c := text[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '\'':
+			end, value, ok := scanQuoted(text, pos)
+			if !ok {
+				return nil, 0, parseError(text, pos, "Unbalanced single quote")
+			}
+			tokens = append(tokens, token{kind: tkString, text: "'" + strings.ReplaceAll(value, "'", "''") + "'", pos: pos})
+			pos = end
+		case c == '"':
+			end, value, ok := scanQuoted(text, pos)
+			if !ok {
+				return nil, 0, parseError(text, pos, "Unbalanced double quote")
+			}
+			tokens = append(tokens, token{kind: tkQuoted, text: value, pos: pos})
+			pos = end
+		case c == '#' && strings.HasPrefix(text[pos:], "##"):
+			end := strings.Index(text[pos+2:], "##")
+			if end == -1 {
+				return nil, 0, parseError(text, pos, "Unterminated faker symbol")
+			}
+			end += pos + 4
+			tokens = append(tokens, token{kind: tkFaker, text: text[pos:end], pos: pos})
+			pos = end
+		case c == '?':
+			params++
+			tokens = append(tokens, token{kind: tkParam, text: fmt.Sprintf("?%d", params), pos: pos})
+			pos++
+		case isDigit(c) || ((c == '-' || c == '+' || c == '.') && pos+1 < len(text) && isDigit(text[pos+1]) && !afterOperand(tokens)):
+			end := pos + 1
+			for end < len(text) && (isDigit(text[end]) || text[end] == '.' || text[end] == 'e' || text[end] == 'E' ||
+				((text[end] == '-' || text[end] == '+') && (text[end-1] == 'e' || text[end-1] == 'E'))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tkNumber, text: text[pos:end], pos: pos})
+			pos = end
+		case isWordChar(c):
+			end := pos + 1
+			for end < len(text) && (isWordChar(text[end]) || isDigit(text[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tkWord, text: text[pos:end], pos: pos})
+			pos = end
+		default:
+			size := 1
+			if pos+1 < len(text) {
+				switch text[pos : pos+2] {
+				case "<>", "<=", ">=", "!=", "||", "<<", ">>":
+					size = 2
+				}
+			}
+			switch c {
+			case '(', '[', '{':
+				stack = append(stack, pos)
+			case ')', ']', '}':
+				if len(stack) == 0 || closing(text[stack[len(stack)-1]]) != c {
+					return nil, 0, parseError(text, pos, fmt.Sprintf("Unbalanced %c", c))
+				}
+				stack = stack[:len(stack)-1]
+			}
+			tokens = append(tokens, token{kind: tkPunct, text: text[pos : pos+size], pos: pos})
+			pos += size
+		}
+	}
+	if len(stack) > 0 {
+		open := stack[len(stack)-1]
+		return nil, 0, parseError(text, open, fmt.Sprintf("Unbalanced %c", text[open]))
+	}
+	return tokens, params, nil
+}
+
+// scanQuoted reads a quoted string or identifier starting at pos, where doubled quotes are escapes
+func scanQuoted(text string, pos int) (int, string, bool) {
+	quote := text[pos]
+	var b strings.Builder
+	for idx := pos + 1; idx < len(text); idx++ {
+		if text[idx] == quote {
+			if idx+1 < len(text) && text[idx+1] == quote {
+				b.WriteByte(quote)
+				idx++
+				continue
+			}
+			return idx + 1, b.String(), true
+		}
+		b.WriteByte(text[idx])
+	}
+	return len(text), "", false
+}
+
+// afterOperand returns true if the last token ends an operand, so a following +/- is an operator
+func afterOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	return last.kind != tkPunct || last.text == ")" || last.text == "]" || last.text == "}"
+}
+
+func closing(c byte) byte {
+	switch c {
+	case '(':
+		return ')'
+	case '[':
+		return ']'
+	}
+	return '}'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// parseError builds a ParseError for a byte offset in a statement
+func parseError(text string, pos int, message string) *ParseError {
+	if pos > len(text) {
+		pos = len(text)
+	}
+	return &ParseError{Line: strings.Count(text[:pos], "\n"), Message: message}
+}
@@ -0,0 +1,112 @@
+package statement
+
+import (
+	"testing"
+)
+
+// whereOf parses a statement and returns its WHERE equalities by name, failing the test on a parse error
+func whereOf(t *testing.T, text string) map[string]Value {
+	t.Helper()
+	p, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Parse(%q) error = %v", text, err)
+	}
+	where := make(map[string]Value, len(p.Where))
+	for _, a := range p.Where {
+		where[a.Name] = a.Value
+	}
+	return where
+}
+
+func TestParseKeyWordsInsideStringsAreValues(t *testing.T) {
+	where := whereOf(t, "DELETE FROM t WHERE pk = 'a OR b' AND sk = 'x AND y = 1'")
+	if len(where) != 2 || where["pk"].String() != "a OR b" || where["sk"].String() != "x AND y = 1" {
+		t.Errorf("Where = %#v, want pk and sk with their literal text", where)
+	}
+}
+
+func TestParseEscapedQuoteInKey(t *testing.T) {
+	where := whereOf(t, "UPDATE t SET x = 1 WHERE pk = 'O''Brien'")
+	v := where["pk"]
+	if v.Text != "'O''Brien'" || v.String() != "O'Brien" {
+		t.Errorf("pk = %q (%q), want 'O''Brien' (O'Brien)", v.Text, v.String())
+	}
+}
+
+func TestParseReversedEquality(t *testing.T) {
+	where := whereOf(t, "DELETE FROM t WHERE 'a' = pk AND 2 = sk")
+	if where["pk"].Text != "'a'" || where["sk"].Text != "2" {
+		t.Errorf("Where = %#v, want pk = 'a' and sk = 2", where)
+	}
+}
+
+func TestParseOrHidesEveryKey(t *testing.T) {
+	// An OR anywhere at the top level means the statement may match other items, even beside an equality
+	for _, text := range []string{
+		"DELETE FROM t WHERE pk = 'a' AND sk = 1 OR sk = 2",
+		"DELETE FROM t WHERE (pk = 'a') OR (pk = 'b')",
+	} {
+		if where := whereOf(t, text); len(where) != 0 {
+			t.Errorf("Where(%q) = %#v, want none", text, where)
+		}
+	}
+}
+
+func TestParsePlaceholdersNumberedAcrossClauses(t *testing.T) {
+	p, err := Parse("UPDATE t SET a = ?, b = ? WHERE pk = ? AND sk = 'x' RETURNING ALL NEW *")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	values, ok := p.Key("pk", "sk")
+	if !ok || values[0].Param != 3 || values[1].Param != 0 || p.Params != 3 {
+		t.Errorf("Key() = %#v, %v with %d params, want placeholder 3 and a literal of 3 params", values, ok, p.Params)
+	}
+}
+
+func TestParsePartialKey(t *testing.T) {
+	p, err := Parse("DELETE FROM t WHERE pk = 'a' AND sk > 1")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if _, ok := p.Key("pk", "sk"); ok {
+		t.Error("Key(pk, sk) found a range condition as the sort key")
+	}
+	if values, ok := p.Key("pk"); !ok || values[0].Text != "'a'" {
+		t.Errorf("Key(pk) = %#v, %v, want 'a'", values, ok)
+	}
+}
+
+func TestParseInsertKeyFromNestedDocument(t *testing.T) {
+	p, err := Parse("INSERT INTO \"bo.users\" VALUE {'doc' : {'userID' : 'inner'}, 'userID' : 'outer'}")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if values, ok := p.Key("userID"); !ok || values[0].Text != "'outer'" {
+		t.Errorf("Key(userID) = %#v, %v, want the top level 'outer'", values, ok)
+	}
+	if p.TableName() != "bo.users" || !p.Quoted {
+		t.Errorf("TableName() = %q, quoted=%v, want the quoted bo.users", p.TableName(), p.Quoted)
+	}
+}
+
+func TestParseUnquotedDottedTable(t *testing.T) {
+	// Unquoted, bo.users reads as table bo and index users, so it is rejected for writes by the executor
+	p, err := Parse("DELETE FROM bo.users WHERE userID = 'a'")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if p.Quoted || p.Table != "bo" || p.Index != "users" || p.TableName() != "bo.users" {
+		t.Errorf("Table, Index, TableName() = %q, %q, %q", p.Table, p.Index, p.TableName())
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	_, err := Parse("UPDATE t\nSET x = 1\nWHERE pk = 'a")
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Parse() error = %#v, want a *ParseError", err)
+	}
+	if pe.Line != 2 {
+		t.Errorf("ParseError.Line = %d, want 2 (the third line)", pe.Line)
+	}
+}
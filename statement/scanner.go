@@ -0,0 +1,251 @@
+package statement
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Kind identifies what a scanned Statement represents
+type Kind int
+
+const (
+	// KindStatement is an executable PartiQL statement
+	KindStatement Kind = iota
+	// KindBreak is a batch boundary directive ("break" on a line of its own)
+	KindBreak
+	// KindBegin starts a transaction block ("BEGIN TRANSACTION")
+	KindBegin
+	// KindCommit ends a transaction block ("COMMIT")
+	KindCommit
+)
+
+var (
+	// A line starting with one of these keywords begins a new statement even when the previous one was not
+	// terminated with a semicolon (one statement per line files). Any other line continues the statement,
+	// e.g. a wrapped "AND ..." condition.
+	statementKeywords = map[string]bool{
+		"SELECT": true,
+		"INSERT": true,
+		"UPDATE": true,
+		"DELETE": true,
+		"EXISTS": true,
+		"BEGIN":  true,
+		"COMMIT": true,
+	}
+
+	directives = map[string]Kind{
+		"BREAK":              KindBreak,
+		"BEGIN":              KindBegin,
+		"BEGIN TRANSACTION":  KindBegin,
+		"START TRANSACTION":  KindBegin,
+		"COMMIT":             KindCommit,
+		"COMMIT TRANSACTION": KindCommit,
+	}
+)
+
+// Statement is a single statement or directive read from a pql input
+type Statement struct {
+	Kind    Kind
+	Text    string
+	Line    int // The line the statement starts on (1 based)
+	EndLine int // The line the statement ends on
+	Seq     int // The ordinal of the statement within its input (1 based)
+}
+
+// Scanner splits a pql input into statements. Statements are terminated by a ';' outside of quoted
+// strings, identifiers and documents, by a "break" directive, by a new line starting with a statement
+// keyword, or by the end of the input. "--" and "/* */" comments are stripped, as are lines starting with '#'.
+// The "break", "BEGIN TRANSACTION" and "COMMIT" directives are returned as statements of their own Kind.
+type Scanner struct {
+	reader *bufio.Reader
+	line   int
+	seq    int
+	err    error
+	eof    bool
+
+	pending   strings.Builder
+	startLine int
+	endLine   int
+	inSingle  bool
+	inDouble  bool
+	inComment bool
+	depth     int
+
+	queue []Statement
+	curr  Statement
+}
+
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		reader: bufio.NewReaderSize(r, 64*1024),
+		queue:  make([]Statement, 0, 4),
+	}
+}
+
+// Scan advances to the next statement, returning false at the end of the input or on a read error
+func (s *Scanner) Scan() bool {
+	for len(s.queue) == 0 {
+		if s.eof {
+			return false
+		}
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			s.eof = true
+		}
+		if len(line) > 0 {
+			s.line++
+			s.scanLine(strings.TrimRight(line, "\r\n"))
+		}
+		if s.eof {
+			s.flush()
+		}
+	}
+	s.curr = s.queue[0]
+	s.queue = s.queue[1:]
+	return true
+}
+
+// Statement returns the statement read by the last call to Scan
+func (s *Scanner) Statement() Statement {
+	return s.curr
+}
+
+// Err returns the first non-EOF error encountered reading the input
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+func (s *Scanner) atTopLevel() bool {
+	return !s.inSingle && !s.inDouble && !s.inComment && s.depth == 0
+}
+
+func (s *Scanner) hasPending() bool {
+	return s.pending.Len() > 0
+}
+
+func (s *Scanner) scanLine(line string) {
+	if s.atTopLevel() {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || isHashComment(trimmed) {
+			return
+		}
+		if kind, ok := directive(strings.TrimSuffix(trimmed, ";")); ok {
+			s.flush()
+			s.emit(Statement{Kind: kind, Text: trimmed, Line: s.line, EndLine: s.line})
+			return
+		}
+		if s.hasPending() && statementKeywords[strings.ToUpper(firstWord(trimmed))] {
+			s.flush()
+		}
+	}
+	if s.hasPending() {
+		s.pending.WriteByte('\n')
+	}
+	runes := []rune(line)
+	size := len(runes)
+	for idx := 0; idx < size; idx++ {
+		c := runes[idx]
+		next := rune(0)
+		if idx+1 < size {
+			next = runes[idx+1]
+		}
+		switch {
+		case s.inComment:
+			if c == '*' && next == '/' {
+				s.inComment = false
+				if s.pending.Len() > 0 {
+					s.pending.WriteByte(' ')
+				}
+				idx++
+			}
+			continue
+		case s.inSingle:
+			if c == '\'' {
+				s.inSingle = false
+			}
+		case s.inDouble:
+			if c == '"' {
+				s.inDouble = false
+			}
+		case c == '-' && next == '-':
+			return
+		case c == '/' && next == '*':
+			s.inComment = true
+			idx++
+			continue
+		case c == '\'':
+			s.inSingle = true
+		case c == '"':
+			s.inDouble = true
+		case c == '{' || c == '[' || c == '(':
+			s.depth++
+		case c == '}' || c == ']' || c == ')':
+			if s.depth > 0 {
+				s.depth--
+			}
+		case c == ';' && s.depth == 0:
+			s.flush()
+			continue
+		}
+		if s.pending.Len() == 0 {
+			if c == ' ' || c == '\t' {
+				continue
+			}
+			s.startLine = s.line
+		}
+		s.endLine = s.line
+		s.pending.WriteRune(c)
+	}
+}
+
+// flush emits the pending statement, if there is one, and resets the parse state
+func (s *Scanner) flush() {
+	text := strings.TrimSpace(s.pending.String())
+	s.pending.Reset()
+	s.inSingle, s.inDouble, s.inComment, s.depth = false, false, false, 0
+	if text == "" {
+		return
+	}
+	kind, ok := directive(text)
+	if !ok {
+		kind = KindStatement
+	}
+	s.emit(Statement{Kind: kind, Text: text, Line: s.startLine, EndLine: s.endLine})
+}
+
+func (s *Scanner) emit(st Statement) {
+	s.seq++
+	st.Seq = s.seq
+	s.queue = append(s.queue, st)
+}
+
+// KindOf returns the Kind of a single statement or directive, e.g. KindBegin for "BEGIN TRANSACTION"
+func KindOf(text string) Kind {
+	if kind, ok := directive(strings.TrimSuffix(strings.TrimSpace(text), ";")); ok {
+		return kind
+	}
+	return KindStatement
+}
+
+// directive returns the Kind of the passed text if it is a directive rather than a statement
+func directive(text string) (Kind, bool) {
+	kind, ok := directives[strings.ToUpper(strings.Join(strings.Fields(text), " "))]
+	return kind, ok
+}
+
+// isHashComment reports whether a line is a '#' comment. "##" starts a faker placeholder, e.g. ##uuid##, and
+// is kept.
+func isHashComment(line string) bool {
+	return strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "##")
+}
+
+func firstWord(s string) string {
+	if idx := strings.IndexAny(s, " \t("); idx != -1 {
+		return s[:idx]
+	}
+	return s
+}
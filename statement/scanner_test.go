@@ -0,0 +1,137 @@
+package statement
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// scanAll returns the statements scanned from the input, failing the test on a read error
+func scanAll(t *testing.T, r io.Reader) []Statement {
+	t.Helper()
+	s := NewScanner(r)
+	statements := make([]Statement, 0, 4)
+	for s.Scan() {
+		statements = append(statements, s.Statement())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	return statements
+}
+
+func texts(statements []Statement) []string {
+	t := make([]string, len(statements))
+	for idx, st := range statements {
+		t[idx] = st.Text
+	}
+	return t
+}
+
+func TestScannerLegacyOneStatementPerLine(t *testing.T) {
+	// Files written before statements could span lines have no semicolons and no blank lines
+	input := "# accounts\nDELETE FROM t WHERE pk = 'a'\n# users\nINSERT INTO t VALUE {'pk' : 'b'}\nupdate t set x = 1 where pk = 'c'\nEXISTS (SELECT * FROM t WHERE pk = 'd')\n"
+	got := scanAll(t, strings.NewReader(input))
+	want := []string{
+		"DELETE FROM t WHERE pk = 'a'",
+		"INSERT INTO t VALUE {'pk' : 'b'}",
+		"update t set x = 1 where pk = 'c'",
+		"EXISTS (SELECT * FROM t WHERE pk = 'd')",
+	}
+	if strings.Join(texts(got), "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q\nwant %q", texts(got), want)
+	}
+	if got[1].Line != 4 || got[3].Line != 6 {
+		t.Errorf("lines %d and %d, want 4 and 6", got[1].Line, got[3].Line)
+	}
+}
+
+func TestScannerContinuationLinesJoinTheStatement(t *testing.T) {
+	got := scanAll(t, strings.NewReader("UPDATE t SET x = 1\nWHERE pk = 'a'\n  AND sk = 2\nDELETE FROM t WHERE pk = 'b'"))
+	if len(got) != 2 || got[0].Text != "UPDATE t SET x = 1\nWHERE pk = 'a'\n  AND sk = 2" || got[0].EndLine != 3 {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestScannerKeywordLinesInsideDocumentsAndComments(t *testing.T) {
+	// Inside a document, a string or a block comment, neither a keyword line nor break ends the statement
+	input := "INSERT INTO t VALUE {\n'pk' : 'a',\n'q' : 'x;\nDELETE y',\nbreak : 1\n}\n/*\nDELETE FROM t;\n*/\nUPDATE t SET x = 1 WHERE pk = 'a';\n"
+	got := scanAll(t, strings.NewReader(input))
+	if len(got) != 2 {
+		t.Fatalf("got %q, want the INSERT and the UPDATE", texts(got))
+	}
+	if got[0].Kind != KindStatement || got[0].Line != 1 || got[0].EndLine != 6 || !strings.Contains(got[0].Text, "'x;\nDELETE y'") {
+		t.Errorf("INSERT = %#v", got[0])
+	}
+	if got[1].Line != 10 {
+		t.Errorf("UPDATE starts on line %d, want 10", got[1].Line)
+	}
+}
+
+func TestScannerFakerPlaceholderLinesAreKept(t *testing.T) {
+	got := scanAll(t, strings.NewReader("INSERT INTO t VALUE {'pk' :\n##uuid##\n}\n"))
+	if len(got) != 1 || got[0].Text != "INSERT INTO t VALUE {'pk' :\n##uuid##\n}" {
+		t.Errorf("got %q", texts(got))
+	}
+}
+
+func TestScannerUnterminatedStringRunsToTheEnd(t *testing.T) {
+	// The scanner cannot tell where a runaway string was meant to end, so the parser reports it
+	got := scanAll(t, strings.NewReader("DELETE FROM t WHERE pk = 'a;\nDELETE FROM t WHERE pk = 'b';\n"))
+	if len(got) != 1 || got[0].EndLine != 2 {
+		t.Errorf("got %#v, want one statement to the end of the input", got)
+	}
+}
+
+func TestScannerDirectivesAreCounted(t *testing.T) {
+	got := scanAll(t, strings.NewReader("DELETE FROM t WHERE pk = 'a'\nbreak\nbegin  transaction;\nDELETE FROM t WHERE pk = 'b';\nCommit\n"))
+	kinds := []Kind{KindStatement, KindBreak, KindBegin, KindStatement, KindCommit}
+	if len(got) != len(kinds) {
+		t.Fatalf("got %q", texts(got))
+	}
+	for idx, st := range got {
+		if st.Kind != kinds[idx] || st.Seq != idx+1 {
+			t.Errorf("statement %d = kind %d, seq %d, want kind %d, seq %d", idx, st.Kind, st.Seq, kinds[idx], idx+1)
+		}
+	}
+}
+
+func TestScannerLongLine(t *testing.T) {
+	// Lines longer than the read buffer are not split
+	value := strings.Repeat("x", 200*1024)
+	got := scanAll(t, strings.NewReader("INSERT INTO t VALUE {'pk' : '"+value+"'}\r\nDELETE FROM t WHERE pk = 'a'"))
+	if len(got) != 2 || len(got[0].Text) != len(value)+len("INSERT INTO t VALUE {'pk' : ''}") || got[1].Line != 2 {
+		t.Errorf("got %d statements, first of %d bytes", len(got), len(got[0].Text))
+	}
+}
+
+// failingReader returns its content and then an error
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestScannerReadError(t *testing.T) {
+	readErr := errors.New("connection reset")
+	s := NewScanner(&failingReader{r: strings.NewReader("DELETE FROM t WHERE pk = 'a';\nDELETE FROM t WHERE pk = 'b"), err: readErr})
+	got := make([]Statement, 0, 2)
+	for s.Scan() {
+		got = append(got, s.Statement())
+	}
+	if s.Err() != readErr {
+		t.Errorf("Err() = %v, want %v", s.Err(), readErr)
+	}
+	// The statements read before the error are still returned
+	if len(got) == 0 || got[0].Text != "DELETE FROM t WHERE pk = 'a'" {
+		t.Errorf("got %q", texts(got))
+	}
+}
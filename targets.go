@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"pql/audit"
+	"pql/cli"
+	"pql/executor"
+	"pql/util"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	STATUS_COMPLETE = "complete"
+	STATUS_FAILURES = "failures"
+	STATUS_STOPPED  = "stopped"
+	STATUS_NOT_RUN  = "not run"
+)
+
+// target is an account and region to execute the input against. With several profiles or regions, the
+// targets run one after the other, each with its own client, stats and output files.
+type target struct {
+	name    string
+	profile string
+	region  string
+	key     string
+	secret  string
+	started time.Time
+
+	operator *audit.Operator // The access key ID the credentials resolved to, once connected
+}
+
+// targetSummary is the final status of a target, for the summary table
+type targetSummary struct {
+	target  *target
+	stats   executor.Stats
+	tables  []executor.TableStats
+	results []*executor.Result
+	elapsed time.Duration
+	stopped bool
+}
+
+// loadTargets resolves the credentials of each of the comma separated profiles, for each of the comma
+// separated regions. Without profiles the credentials come from the environment, and without regions
+// each profile's own region is used.
+func loadTargets(profiles, regions string) ([]target, error) {
+	regionList := splitList(regions)
+	targets := make([]target, 0, 4)
+	add := func(profile, key, secret, region string) {
+		if len(regionList) == 0 {
+			targets = append(targets, target{name: profile, profile: profile, region: region, key: key, secret: secret})
+			return
+		}
+		for _, r := range regionList {
+			n := r
+			if profile != "" {
+				n = profile + "/" + r
+			}
+			targets = append(targets, target{name: n, profile: profile, region: r, key: key, secret: secret})
+		}
+	}
+	profileList := splitList(profiles)
+	if len(profileList) == 0 {
+		add("", util.Env("", cli.AWS_KEY_ENV), util.Env("", cli.AWS_SECRET_ENV), util.Env(cli.DEFAULT_REGION, cli.AWS_REGION_ENV))
+	}
+	for _, p := range profileList {
+		key, secret, region, err := cli.ProfileCreds(p)
+		if err != nil {
+			return nil, err
+		}
+		add(p, key, secret, region)
+	}
+	for idx := range targets {
+		if targets[idx].name == "" {
+			targets[idx].name = targets[idx].region
+		}
+	}
+	return targets, nil
+}
+
+// targetFileName returns the name of an output file for a target. With several targets, each gets its own
+// file, named with the target inserted before the extension (e.g. failed.QA.pql, or failed.QA.pql.gz).
+func targetFileName(fileName string, t *target) string {
+	if fileName == "" || len(targets) < 2 {
+		return fileName
+	}
+	name, zext := fileName, ""
+	if executor.CompressionOf(fileName) != "" {
+		zext = filepath.Ext(fileName)
+		name = strings.TrimSuffix(fileName, zext)
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + strings.ReplaceAll(t.name, "/", "-") + ext + zext
+}
+
+// printSummary prints a table of the final status of every target
+func printSummary() {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "TARGET\tREGION\tEXECUTED\tFAILED\tRETRIES\tCAPACITY\tELAPSED\tSTATUS\n")
+	for idx := range targets {
+		t := &targets[idx]
+		s := summaryOf(t)
+		if s == nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t%s\n", t.name, t.region, STATUS_NOT_RUN)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", t.name, t.region, s.stats.Executed, s.stats.Failed, s.stats.Retries, s.stats.CapacityUnits, s.elapsed.Round(time.Millisecond), s.status())
+	}
+	w.Flush()
+}
+
+// summaryOf returns the final status of a target, or nil if it has not run
+func summaryOf(t *target) *targetSummary {
+	for idx := range summaries {
+		if summaries[idx].target == t {
+			return &summaries[idx]
+		}
+	}
+	return nil
+}
+
+func (s *targetSummary) status() string {
+	if s.stopped {
+		return STATUS_STOPPED
+	} else if s.stats.Failed > 0 {
+		return STATUS_FAILURES
+	}
+	return STATUS_COMPLETE
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0, 4)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -1,4 +1,4 @@
-package main
+package truncate
 
 import (
 	"context"
@@ -6,17 +6,16 @@ import (
 	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/smithy-go"
 	"log"
 	"os"
-	"pql/creds"
+	"pql/audit"
+	"pql/cli"
+	"pql/guard"
+	"pql/metrics"
 	"pql/util"
-	"pql/version"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,24 +23,25 @@ import (
 )
 
 const (
-	AWS_KEY_ENV    = "AWS_ACCESS_KEY_ID"
-	AWS_SECRET_ENV = "AWS_SECRET_ACCESS_KEY"
-	AWS_REGION_ENV = "AWS_REGION"
-
 	MAX_BATCH_SIZE = 25
 	ONE            = int32(1)
 	MINUS_ONE      = int32(-1)
+
+	// The exit status of a truncation stopped by SIGINT or SIGTERM
+	EXIT_INTERRUPTED = 130
+	// The exit status of a truncation ended by an error
+	EXIT_FAILED = -1
 )
 
 var (
-	maxRetries int
-	profile    string
-	table      string
-	readers    int
+	maxRetries  int
+	table       string
+	readers     int
+	metricsAddr string
+	drainSecs   int
+	override    bool
 
-	dbAwsKeyId     string
-	dbAwsSecretKey string
-	dbAwsRegion    string
+	conn cli.Connection
 
 	rowsRetrieved = new(int32)
 	rowsDeleted   = new(int32)
@@ -50,10 +50,27 @@ var (
 	workers       = new(int32)
 	getCapUsed    = new(int64)
 	deleteCapUsed = new(int64)
+	stopped       = new(int32)
+
+	shutdown <-chan struct{}
+
+	record    *audit.Run
+	startTime time.Time
 
 	dbClient *dynamodb.Client
 
 	indexes []TableIndex
+
+	scanLatency   *metrics.Histogram
+	deleteLatency *metrics.Histogram
+
+	// Command is the "pql truncate" command, which was the ddbtruncate tool
+	Command = &cli.Command{
+		Name:    "truncate",
+		Summary: "Delete every item in a table, with parallel scans and batch deletes",
+		Define:  define,
+		Run:     run,
+	}
 )
 
 func reportStats(final bool) {
@@ -75,61 +92,115 @@ func reportStats(final bool) {
 	)
 }
 
+// truncateCounters are the final counters of a truncation, for the audit log
+type truncateCounters struct {
+	Table          string `json:"table"`
+	Keys           int32  `json:"keys"`
+	Deleted        int32  `json:"deleted"`
+	Resubmits      int32  `json:"resubmits"`
+	Retries        int32  `json:"retries"`
+	ScanCapacity   int64  `json:"scanCapacityUnits"`
+	DeleteCapacity int64  `json:"deleteCapacityUnits"`
+}
+
+// auditRun appends the record of the truncation to the audit log
+func auditRun(startTime time.Time, exitStatus int) {
+	status, finished := "complete", time.Now()
+	if exitStatus == EXIT_INTERRUPTED {
+		status = "stopped"
+	} else if exitStatus != 0 {
+		status = "failed"
+	}
+	record.Targets = []audit.RunTarget{{
+		Name:     conn.Name(),
+		Profile:  conn.Profile,
+		Region:   conn.Region,
+		Operator: conn.Operator.String(),
+		Status:   status,
+		Started:  &startTime,
+		Finished: &finished,
+		Counters: truncateCounters{
+			Table:          table,
+			Keys:           atomic.LoadInt32(rowsRetrieved),
+			Deleted:        atomic.LoadInt32(rowsDeleted),
+			Resubmits:      atomic.LoadInt32(resubs),
+			Retries:        atomic.LoadInt32(retries),
+			ScanCapacity:   atomic.LoadInt64(getCapUsed),
+			DeleteCapacity: atomic.LoadInt64(deleteCapUsed),
+		},
+	}}
+	if err := record.Finish(exitStatus, conn.Endpoint); err != nil {
+		log.Printf("WARNING: Failed to write audit record: file=%s, error=%s\n", audit.FileName(), err.Error())
+	}
+}
+
+// exitFailed reports the error a truncation cannot carry on from, records the run in the audit log, and exits
+func exitFailed(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("ERROR: %s\n", message)
+	reportStats(true)
+	record.Error = message
+	auditRun(startTime, EXIT_FAILED)
+	os.Exit(EXIT_FAILED)
+}
+
+func registerMetrics() {
+	metrics.CounterFunc("truncate_keys_scanned_total", "The number of keys scanned", func() float64 {
+		return float64(atomic.LoadInt32(rowsRetrieved))
+	})
+	metrics.CounterFunc("truncate_rows_deleted_total", "The number of rows deleted", func() float64 {
+		return float64(atomic.LoadInt32(rowsDeleted))
+	})
+	metrics.CounterFunc("truncate_resubmits_total", "The number of unprocessed deletes resubmitted", func() float64 {
+		return float64(atomic.LoadInt32(resubs))
+	})
+	metrics.CounterFunc("truncate_retries_total", "The number of delete batch retries", func() float64 {
+		return float64(atomic.LoadInt32(retries))
+	})
+	metrics.CounterFunc("truncate_scan_capacity_units_total", "The capacity units consumed by scans", func() float64 {
+		return float64(atomic.LoadInt64(getCapUsed))
+	})
+	metrics.CounterFunc("truncate_delete_capacity_units_total", "The capacity units consumed by deletes", func() float64 {
+		return float64(atomic.LoadInt64(deleteCapUsed))
+	})
+	metrics.GaugeFunc("truncate_workers", "The number of running scan workers", func() float64 {
+		return float64(atomic.LoadInt32(workers))
+	})
+	scanLatency = metrics.NewHistogram("truncate_scan_latency_seconds", "The latency of Scan calls", metrics.DefaultBuckets)
+	deleteLatency = metrics.NewHistogram("truncate_delete_latency_seconds", "The latency of BatchWriteItem calls", metrics.DefaultBuckets)
+}
+
 type TableIndex struct {
 	columnName string
 	columnType types.ScalarAttributeType
 }
 
-func init() {
-
-	flag.StringVar(&profile, "profile", "", "The optional AWS shared config credential profile name")
-	flag.StringVar(&table, "table", "", "The table to truncate")
-	flag.IntVar(&maxRetries, "maxretries", -1, "The maximum number of retries for a capacity failure (-1 for infinite)")
-	flag.IntVar(&readers, "readers", 64, "The number of reader routines to parallel scan and batch delete with")
-
-	usage := flag.Usage
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "truncate: v%s\n", version.VERSION)
-		usage()
-	}
-	flag.Parse()
+func define(fs *flag.FlagSet) {
+	conn.Flags(fs)
+	fs.StringVar(&table, "table", "", "The table to truncate")
+	fs.IntVar(&maxRetries, "maxretries", -1, "The maximum number of retries for a capacity failure (-1 for infinite)")
+	fs.IntVar(&readers, "readers", 64, "The number of reader routines to parallel scan and batch delete with")
+	fs.IntVar(&drainSecs, "drain", 30, "The maximum time in seconds to wait for in-flight deletes to complete after SIGINT or SIGTERM")
+	fs.StringVar(&metricsAddr, "metrics", "", "The optional address to serve Prometheus metrics on (e.g. :9102)")
+	fs.BoolVar(&override, guard.OVERRIDE_FLAG, false, guard.OVERRIDE_USAGE)
+}
 
+func run(fs *flag.FlagSet) {
 	if table == "" {
 		fmt.Fprintf(os.Stderr, "ERROR: No table specified\n")
 		os.Exit(-9)
 	}
-
-	if profile != "" {
-		pcfg, err := creds.GetProfileCreds(profile)
-		if err != nil {
-			fmt.Printf("ERROR: Failed to load credentials for profile [%s]: %s\n", profile, err.Error())
-			os.Exit(-10)
-		}
-		//fmt.Printf("Loaded Profile: source=%s\n", pcfg[0])
-		dbAwsKeyId = pcfg[1]
-		dbAwsSecretKey = pcfg[2]
-		dbAwsRegion = pcfg[3]
-	} else {
-		dbAwsKeyId = util.Env("", AWS_KEY_ENV)
-		dbAwsSecretKey = util.Env("", AWS_SECRET_ENV)
-		dbAwsRegion = util.Env("us-east-1", AWS_REGION_ENV)
+	conn.Resolve()
+	g := guard.FromEnv("truncate", override)
+	if err := g.Confirm(guard.Target{Name: conn.Name(), Profile: conn.Profile, Region: conn.Region}, []guard.Operation{{Op: guard.OP_TRUNCATE, Table: table}}); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+		os.Exit(-9)
 	}
-}
 
-func main() {
-
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(dbAwsRegion),
-		config.WithCredentialsProvider(creds.NewChainedCredentialProvider(
-			credentials.NewStaticCredentialsProvider(dbAwsKeyId, dbAwsSecretKey, ""),
-			ec2rolecreds.New(),
-		)),
-	)
-
-	if err != nil {
-		log.Fatalf("unable to load SDK config, %v", err)
-	}
-	dbClient = dynamodb.NewFromConfig(cfg)
+	record = audit.NewRun("truncate")
+	startTime = time.Now()
+	dbClient = conn.Client()
+	cli.ServeMetrics(metricsAddr, registerMetrics)
 	indexes = GetTableIndexes()
 	attrNames := make([]string, 0)
 	for _, index := range indexes {
@@ -137,16 +208,25 @@ func main() {
 	}
 
 	log.Printf("Starting table truncation: table=%s, keys=%s\n", table, attrNames)
-	go func() {
-		for {
-			time.Sleep(5 * time.Second)
-			reportStats(false)
+	cli.ReportEvery(5*time.Second, reportStats)
+	shutdown = util.NotifyShutdown(func(sig os.Signal, again bool) {
+		if again {
+			log.Printf("Exiting Without Draining: signal=%s, workers=%d\n", sig, atomic.LoadInt32(workers))
+			reportStats(true)
+			auditRun(startTime, EXIT_INTERRUPTED)
+			os.Exit(EXIT_INTERRUPTED)
 		}
-	}()
-	startTime := time.Now()
+		log.Printf("Shutdown Requested: signal=%s, stopping scans and draining in-flight deletes (signal again to exit now)\n", sig)
+	})
 	StartScan()
 	reportStats(true)
 	log.Printf("Elapsed: %s\n", time.Since(startTime).String())
+	if util.IsClosed(shutdown) {
+		log.Printf("Truncation Stopped: table=%s, incompleteSegments=%d, totalSegments=%d (run again to delete the remaining items)\n", table, atomic.LoadInt32(stopped), readers)
+		auditRun(startTime, EXIT_INTERRUPTED)
+		os.Exit(EXIT_INTERRUPTED)
+	}
+	auditRun(startTime, 0)
 	os.Exit(0)
 }
 
@@ -158,7 +238,18 @@ func StartScan() {
 		go doSegment(scan, &scanWg)
 	}
 	log.Printf("All readers running: %d\n", readers)
-	scanWg.Wait()
+	done := make(chan struct{})
+	go func() {
+		scanWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdown:
+		if util.WaitTimeout(&scanWg, time.Duration(drainSecs)*time.Second) {
+			log.Printf("WARNING: Timed out draining in-flight deletes: timeout=%ds, workers=%d\n", drainSecs, atomic.LoadInt32(workers))
+		}
+	}
 	log.Printf("Total Rows: %d\n", atomic.LoadInt32(rowsRetrieved))
 }
 
@@ -171,12 +262,19 @@ func doSegment(input *dynamodb.ScanInput, scanWg *sync.WaitGroup) {
 	rows := 0
 	deleted := 0
 	for {
-		if out, err := dbClient.Scan(context.Background(), input); err != nil {
+		if util.IsClosed(shutdown) {
+			atomic.AddInt32(stopped, ONE)
+			break
+		}
+		scanStart := time.Now()
+		out, err := dbClient.Scan(context.Background(), input)
+		scanLatency.ObserveSince(scanStart)
+		if err != nil {
 			var oe *smithy.OperationError
 			if errors.As(err, &oe) {
-				log.Fatalf("Scan OE Error: %s\n", oe.Error())
+				exitFailed("Scan OE Error: %s", oe.Error())
 			} else {
-				log.Fatalf("Scan Error: %s\n", err.Error())
+				exitFailed("Scan Error: %s", err.Error())
 			}
 		} else {
 			atomic.AddInt64(getCapUsed, int64(*out.ConsumedCapacity.CapacityUnits))
@@ -264,7 +362,10 @@ func doDeletes(items []map[string]types.AttributeValue, nested int) int {
 			deleteBatch := buildDeleteOp(batch)
 			originalBatchSize := len(deleteBatch[table])
 			batchWrite := &dynamodb.BatchWriteItemInput{RequestItems: deleteBatch, ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal}
-			if out, err := dbClient.BatchWriteItem(context.Background(), batchWrite); err != nil {
+			deleteStart := time.Now()
+			out, err := dbClient.BatchWriteItem(context.Background(), batchWrite)
+			deleteLatency.ObserveSince(deleteStart)
+			if err != nil {
 				var oe *smithy.OperationError
 				// retry quota exceeded
 				if errors.As(err, &oe) {
@@ -272,17 +373,14 @@ func doDeletes(items []map[string]types.AttributeValue, nested int) int {
 						total := atomic.AddInt32(retries, ONE)
 						if maxRetries > -1 {
 							if total > int32(maxRetries) {
-								log.Fatalf("Max Retries Exceeded: %d\n", total)
-								os.Exit(-1)
+								exitFailed("Max Retries Exceeded: %d", total)
 							}
 						}
 						continue
 					}
-					log.Fatalf("Delete OE Error: %s\n", oe.Error())
-					os.Exit(-1)
+					exitFailed("Delete OE Error: %s", oe.Error())
 				} else {
-					log.Fatalf("Delete Error: %s\n", err.Error())
-					os.Exit(-1)
+					exitFailed("Delete Error: %s", err.Error())
 				}
 			} else {
 				atomic.AddInt64(deleteCapUsed, int64(*out.ConsumedCapacity[0].CapacityUnits))
@@ -341,7 +439,8 @@ func BuildScanRequests() []*dynamodb.ScanInput {
 
 func GetTableIndexes() []TableIndex {
 	if desc, err := dbClient.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: &table}); err != nil {
-		panic(err)
+		exitFailed("Describe Table Error: %s", err.Error())
+		return nil
 	} else {
 		indexes := make([]TableIndex, 0)
 		attrTypes := make(map[string]types.ScalarAttributeType, 3)
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyShutdown returns a channel that is closed when the process receives SIGINT or SIGTERM, so the
+// caller can stop taking new work and drain what is in flight. onSignal is called with each signal
+// received, along with true for the second and later signals, when the caller should exit right away.
+func NotifyShutdown(onSignal func(sig os.Signal, again bool)) <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		onSignal(sig, false)
+		close(stop)
+		for sig := range signals {
+			onSignal(sig, true)
+		}
+	}()
+	return stop
+}
+
+// IsClosed returns true if the passed channel has been closed
+func IsClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
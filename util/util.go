@@ -191,26 +191,27 @@ func GetNumberOrNil(value string) *int64 {
 	return &i64
 }
 
+// IsFileGzipped returns true if the named file starts with a gzip header. A file that cannot be opened or
+// read is not gzipped.
 func IsFileGzipped(fileName string) bool {
 	file, err := os.Open(fileName)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return false
 	}
 	defer file.Close()
 	buff := make([]byte, 6)
 
-	_, err = file.Read(buff)
+	n, _ := io.ReadFull(file, buff)
 
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+	return IsGzipped(buff[:n])
 
-	filetype := http.DetectContentType(buff)
+}
 
-	return "application/x-gzip" == filetype;
+// IsGzipped returns true if the passed leading bytes of some content are a gzip header
+func IsGzipped(head []byte) bool {
+	filetype := http.DetectContentType(head)
 
+	return "application/x-gzip" == filetype;
 }
 
 func Env(defaultValue string, keys ...string) string {
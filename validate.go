@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"pql/ddb"
+	"pql/executor"
+	"pql/statement"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// validator checks pql input without executing it, printing each problem found as file:line: message
+type validator struct {
+	schemas    *ddb.Schemas
+	problems   int
+	statements int
+}
+
+// validateFiles parses every statement in the input files and checks it against the key schemas of the
+// tables it references, returning the number of problems found
+func validateFiles(names []string) int {
+	v := &validator{schemas: schemas}
+	if paramStatement != "" {
+		v.statements++
+		if p, ok := v.parse("-statement", 1, paramStatement); ok {
+			v.check("-statement", 1, p)
+			if len(columns) > 0 && len(columns) != p.Params {
+				v.report("-statement", 1, "Statement has %d placeholders but %d -columns were specified", p.Params, len(columns))
+			}
+		}
+	} else {
+		for _, name := range names {
+			v.validateFile(name)
+		}
+	}
+	log.Printf("Validation Complete: files=%d, statements=%d, problems=%d\n", len(names), v.statements, v.problems)
+	return v.problems
+}
+
+func (v *validator) validateFile(fileName string) {
+	file, err := executor.OpenInput(fileName)
+	if err != nil {
+		v.report(fileName, 0, "Failed to open file: %s", err.Error())
+		return
+	}
+	defer file.Close()
+	// The first line each operation type appears on, outside of transactions
+	opLines := make(map[string]int)
+	ops := make([]string, 0, 3)
+	inTxn := false
+	txnLine := 0
+	txnSize := 0
+	txnSelects := 0
+	scanner := statement.NewScanner(file)
+	for scanner.Scan() {
+		st := scanner.Statement()
+		switch st.Kind {
+		case statement.KindBreak:
+			if inTxn {
+				v.report(fileName, st.Line, "break inside the transaction started on line %d is ignored", txnLine)
+			}
+			continue
+		case statement.KindBegin:
+			if inTxn {
+				v.report(fileName, txnLine, "BEGIN TRANSACTION has no COMMIT before the next BEGIN TRANSACTION on line %d", st.Line)
+			}
+			inTxn, txnLine, txnSize, txnSelects = true, st.Line, 0, 0
+			continue
+		case statement.KindCommit:
+			if !inTxn {
+				v.report(fileName, st.Line, "COMMIT without BEGIN TRANSACTION")
+			} else if txnSize > executor.MAX_TRANSACTION_SIZE {
+				v.report(fileName, txnLine, "Transaction has %d statements, the maximum is %d", txnSize, executor.MAX_TRANSACTION_SIZE)
+			} else if txnSelects > 0 && txnSelects < txnSize {
+				v.report(fileName, txnLine, "Transaction mixes SELECT statements with writes")
+			}
+			inTxn = false
+			continue
+		}
+		v.statements++
+		p, ok := v.parse(fileName, st.Line, st.Text)
+		if !ok {
+			continue
+		}
+		v.check(fileName, st.Line, p)
+		if inTxn {
+			txnSize++
+			if p.Op == statement.OP_SELECT {
+				txnSelects++
+			}
+		} else if _, seen := opLines[p.Op]; !seen && p.Op != statement.OP_SELECT {
+			// A SELECT is executed on its own between the batches around it, so it mixes with anything
+			opLines[p.Op] = st.Line
+			ops = append(ops, p.Op)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		v.report(fileName, 0, "Failed to read file: %s", err.Error())
+	}
+	if inTxn {
+		v.report(fileName, txnLine, "BEGIN TRANSACTION has no COMMIT")
+	}
+	if len(ops) > 1 {
+		desc := make([]string, len(ops))
+		for idx, op := range ops {
+			desc[idx] = fmt.Sprintf("%s (line %d)", op, opLines[op])
+		}
+		v.report(fileName, opLines[ops[1]], "File mixes operation types: %s", strings.Join(desc, ", "))
+	}
+}
+
+func (v *validator) parse(fileName string, line int, text string) (*statement.Parsed, bool) {
+	p, err := statement.Parse(text)
+	if err != nil {
+		var pe *statement.ParseError
+		if errors.As(err, &pe) {
+			line += pe.Line
+		}
+		v.report(fileName, line, "%s", err.Error())
+		return nil, false
+	}
+	return p, true
+}
+
+// check validates a parsed statement against the key schema of its table
+func (v *validator) check(fileName string, line int, p *statement.Parsed) {
+	switch p.Op {
+	case statement.OP_EXISTS:
+		v.report(fileName, line, "%s statements are not executed by pql, use pqlquery", p.Op)
+		return
+	}
+	if !p.Quoted && p.Index != "" {
+		v.report(fileName, line, "Table name %s contains a dot and must be double quoted", p.TableName())
+		return
+	}
+	schema, err := v.schemas.Get(p.Table)
+	if err != nil {
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			v.report(fileName, line, "Table %s does not exist", p.Table)
+		} else {
+			code, message := executor.ErrorCode(err)
+			v.report(fileName, line, "Failed to describe table %s: %s: %s", p.Table, code, message)
+		}
+		return
+	}
+	if p.Op == statement.OP_SELECT {
+		// A SELECT may scan, so it needs no key
+		return
+	}
+	if _, ok := p.Key(schema.Names()...); !ok {
+		missing := make([]string, 0, 2)
+		for _, name := range schema.Names() {
+			if _, found := p.Key(name); !found {
+				missing = append(missing, name)
+			}
+		}
+		if p.Op == statement.OP_INSERT {
+			v.report(fileName, line, "INSERT document is missing the key attributes of %s: %s", p.Table, strings.Join(missing, ", "))
+		} else {
+			v.report(fileName, line, "%s does not constrain the full primary key of %s with WHERE equalities: missing %s", p.Op, p.Table, strings.Join(missing, ", "))
+		}
+	}
+	for _, a := range p.Set {
+		for _, name := range schema.Names() {
+			if a.Name == name {
+				v.report(fileName, line, "UPDATE cannot SET the key attribute %s of %s", name, p.Table)
+			}
+		}
+	}
+}
+
+func (v *validator) report(fileName string, line int, format string, args ...interface{}) {
+	v.problems++
+	if line > 0 {
+		fmt.Printf("%s:%d: %s\n", fileName, line, fmt.Sprintf(format, args...))
+	} else {
+		fmt.Printf("%s: %s\n", fileName, fmt.Sprintf(format, args...))
+	}
+}